@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Artifacts is a local directory collecting the output of a run. A nil
+// *Artifacts is valid and discards everything.
+type Artifacts struct {
+	dir string
+}
+
+// NewArtifacts creates the artifacts directory. If dir is empty, no artifacts
+// are collected and a nil *Artifacts is returned.
+func NewArtifacts(dir string) (*Artifacts, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Artifacts{dir: dir}, nil
+}
+
+// Path returns the path of name inside the artifacts directory.
+func (a *Artifacts) Path(name string) string {
+	return filepath.Join(a.dir, name)
+}
+
+// stepName returns the name of the output of step i, e.g. "step-01".
+func stepName(i int) string {
+	return fmt.Sprintf("step-%02d", i+1)
+}
+
+// Output creates the name.stdout.log and name.stderr.log files. Both are nil
+// if artifacts are disabled.
+func (a *Artifacts) Output(name string) (stdout, stderr io.WriteCloser, err error) {
+	if a == nil {
+		return nil, nil, nil
+	}
+
+	outFile, err := os.Create(a.Path(name + ".stdout.log"))
+	if err != nil {
+		return nil, nil, err
+	}
+	errFile, err := os.Create(a.Path(name + ".stderr.log"))
+	if err != nil {
+		outFile.Close()
+		return nil, nil, err
+	}
+	return outFile, errFile, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Verdicts of a bisection step.
+const (
+	bisectGood = "good"
+	bisectBad  = "bad"
+	// bisectSkip means the template couldn't be tested, e.g. it failed to
+	// provision, and says nothing about the regression.
+	bisectSkip = "skip"
+)
+
+// loadTemplateList reads a list of templates, one per line from the oldest
+// to the newest. Blank lines and lines starting with # are ignored.
+func loadTemplateList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read template list")
+	}
+	defer f.Close()
+
+	templates := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if seen[line] {
+			return nil, errors.Errorf("%s is listed twice in %s", line, path)
+		}
+		seen[line] = true
+		templates = append(templates, line)
+	}
+	return templates, scanner.Err()
+}
+
+// bisectVerdict tells whether a run of a bisection found the regression. With
+// a pattern, only the top-level tests it selects count, as in go test -run.
+// Runs in which none of them ran are skipped.
+func bisectVerdict(report *RunReport, pattern string) string {
+	if report.StackID == "" {
+		// The environment couldn't be provisioned.
+		return bisectSkip
+	}
+	re, err := regexp.Compile(strings.SplitN(pattern, "/", 2)[0])
+	if err != nil {
+		return bisectSkip
+	}
+
+	ran, failed := false, false
+	for _, t := range report.Tests() {
+		if strings.Contains(t.Name, "/") || !re.MatchString(t.Name) {
+			continue
+		}
+		ran = true
+		if t.Status == TestFail {
+			failed = true
+		}
+	}
+	switch {
+	case failed:
+		return bisectBad
+	case ran:
+		return bisectGood
+	case pattern == "" && report.Failed():
+		// Nothing parsed as a test result, judge by the run.
+		return bisectBad
+	}
+	return bisectSkip
+}
+
+// bisect finds the first bad template of templates, knowing that good is good
+// and bad is bad. probe tests a template and returns its verdict.
+func bisect(templates []string, good, bad string, probe func(template string) (string, error)) (string, error) {
+	goodIndex, badIndex := -1, -1
+	for i, t := range templates {
+		switch t {
+		case good:
+			goodIndex = i
+		case bad:
+			badIndex = i
+		}
+	}
+	if goodIndex < 0 {
+		return "", errors.Errorf("good template %s is not in the list", good)
+	}
+	if badIndex < 0 {
+		return "", errors.Errorf("bad template %s is not in the list", bad)
+	}
+	if goodIndex >= badIndex {
+		return "", errors.New("the good template must be listed before the bad one")
+	}
+
+	skipped := map[int]bool{}
+	for {
+		i := nextBisectIndex(goodIndex, badIndex, skipped)
+		if i < 0 {
+			break
+		}
+		left := badIndex - goodIndex - 1 - len(skipped)
+		logrus.Infof("==> Bisecting: %d templates left to test (roughly %d steps), testing %s",
+			left, int(math.Ceil(math.Log2(float64(left+1)))), templates[i])
+
+		verdict, err := probe(templates[i])
+		if err != nil {
+			return "", err
+		}
+		logrus.Infof("==> %s is %s", templates[i], verdict)
+		switch verdict {
+		case bisectGood:
+			goodIndex = i
+		case bisectBad:
+			badIndex = i
+		default:
+			skipped[i] = true
+		}
+		for s := range skipped {
+			if s <= goodIndex || s >= badIndex {
+				delete(skipped, s)
+			}
+		}
+	}
+
+	if len(skipped) > 0 {
+		candidates := []string{}
+		for i := goodIndex + 1; i <= badIndex; i++ {
+			candidates = append(candidates, templates[i])
+		}
+		return "", errors.Errorf("templates were skipped, the first bad template is one of %s", strings.Join(candidates, ", "))
+	}
+	return templates[badIndex], nil
+}
+
+// nextBisectIndex returns the index of the template to test next, the closest
+// to the middle of good and bad which wasn't skipped, or -1 if there is none.
+func nextBisectIndex(good, bad int, skipped map[int]bool) int {
+	mid := good + (bad-good)/2
+	for d := 0; mid-d > good || mid+d < bad; d++ {
+		for _, i := range []int{mid - d, mid + d} {
+			if i > good && i < bad && !skipped[i] {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// cachedVerdict returns the verdict of a previous bisection run of a template,
+// or "" if there is none. Only runs of the same config and test pattern count.
+func cachedVerdict(history *History, config, template, pattern string) (string, error) {
+	records, err := history.List(HistoryFilter{Template: template})
+	if err != nil {
+		return "", err
+	}
+	for _, r := range records {
+		if r.Command != "bisect" || r.Config != config || r.Template() != template || r.TestRun != pattern {
+			continue
+		}
+		if verdict := bisectVerdict(r.RunReport, pattern); verdict != bisectSkip {
+			return verdict, nil
+		}
+	}
+	return "", nil
+}
+
+// bisectRunName is the name of the run of the i-th template of a bisection.
+func bisectRunName(i int) string {
+	return fmt.Sprintf("bisect-%02d", i)
+}
+
+// bisectConfig returns the config running the tests selected by pattern on
+// the i-th template of a bisection.
+func bisectConfig(config *Config, i int, template, pattern string) *Config {
+	c := *config
+	environment := *config.Environment
+	environment.Template = template
+	c.Environment = &environment
+
+	c.Env = map[string]EnvValue{}
+	for name, value := range config.Env {
+		c.Env[name] = value
+	}
+	c.Env[testRunVar] = EnvValue{Value: pattern}
+
+	if config.Artifacts != "" {
+		c.Artifacts = filepath.Join(config.Artifacts, bisectRunName(i))
+	}
+	return &c
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTemplates(n int) []string {
+	templates := []string{}
+	for i := 0; i < n; i++ {
+		templates = append(templates, fmt.Sprintf("https://docker-for-aws.s3.amazonaws.com/aws/nightly/%d.json", i))
+	}
+	return templates
+}
+
+func TestBisect(t *testing.T) {
+	templates := testTemplates(10)
+	for firstBad := 1; firstBad < len(templates); firstBad++ {
+		probed := []string{}
+		probe := func(template string) (string, error) {
+			probed = append(probed, template)
+			for i, t := range templates {
+				if t == template && i >= firstBad {
+					return bisectBad, nil
+				}
+			}
+			return bisectGood, nil
+		}
+		first, err := bisect(templates, templates[0], templates[9], probe)
+		assert.NoError(t, err)
+		assert.Equal(t, templates[firstBad], first)
+		assert.True(t, len(probed) <= 4, "%d templates probed", len(probed))
+		assert.NotContains(t, probed, templates[0])
+		assert.NotContains(t, probed, templates[9])
+	}
+}
+
+func TestBisectSkip(t *testing.T) {
+	templates := testTemplates(6)
+	verdicts := map[string]string{
+		templates[1]: bisectGood,
+		templates[2]: bisectSkip,
+		templates[3]: bisectGood,
+		templates[4]: bisectBad,
+	}
+	probe := func(template string) (string, error) {
+		return verdicts[template], nil
+	}
+	first, err := bisect(templates, templates[0], templates[5], probe)
+	assert.NoError(t, err, "skipped templates around the regression are still tested")
+	assert.Equal(t, templates[4], first)
+
+	verdicts[templates[3]] = bisectSkip
+	_, err = bisect(templates, templates[0], templates[5], probe)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), templates[2])
+	assert.Contains(t, err.Error(), templates[4])
+	assert.NotContains(t, err.Error(), templates[1])
+
+	_, err = bisect(templates, templates[5], templates[0], probe)
+	assert.Error(t, err)
+	_, err = bisect(templates, "https://example.com/template.json", templates[0], probe)
+	assert.Error(t, err)
+}
+
+func TestBisectVerdict(t *testing.T) {
+	report := &RunReport{
+		StackID: "arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e/1",
+		Steps: []StepReport{{Tests: []TestResult{
+			{Name: "TestNetworkExternalLb", Status: TestPass},
+			{Name: "TestNetworkExternalLb/ingress", Status: TestPass},
+			{Name: "TestServicesRollingUpdateSucceed", Status: TestFail},
+		}}},
+		Error: "exit status 1",
+	}
+	assert.Equal(t, bisectGood, bisectVerdict(report, "TestNetworkExternalLb"))
+	assert.Equal(t, bisectBad, bisectVerdict(report, "TestServices"))
+	assert.Equal(t, bisectBad, bisectVerdict(report, ""))
+	assert.Equal(t, bisectSkip, bisectVerdict(report, "TestSecrets"))
+
+	report.Steps = nil
+	assert.Equal(t, bisectBad, bisectVerdict(report, ""))
+	report.StackID = ""
+	assert.Equal(t, bisectSkip, bisectVerdict(report, ""))
+}
+
+func TestLoadTemplateList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bisect")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "templates.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# nightlies\nhttps://example.com/1.json\n\n  https://example.com/2.json\n"), 0644))
+	templates, err := loadTemplateList(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/1.json", "https://example.com/2.json"}, templates)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("https://example.com/1.json\nhttps://example.com/1.json\n"), 0644))
+	_, err = loadTemplateList(path)
+	assert.Error(t, err)
+}
+
+func TestBisectCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bisect")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	history, err := OpenHistory(filepath.Join(dir, "history.db"))
+	assert.NoError(t, err)
+	defer history.Close()
+
+	templates := testTemplates(2)
+	add := func(command, template, pattern string, tests ...TestResult) {
+		record := testHistoryRecord(template, time.Now(), tests...)
+		record.Command = command
+		record.StackID = "arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e/1"
+		record.TestRun = pattern
+		assert.NoError(t, history.Add(record))
+	}
+	add("bisect", templates[0], "TestNetworkExternalLb", TestResult{Name: "TestNetworkExternalLb", Status: TestFail})
+	add("run", templates[1], "TestNetworkExternalLb", TestResult{Name: "TestNetworkExternalLb", Status: TestPass})
+	add("bisect", templates[1], "TestServices", TestResult{Name: "TestServicesCreate", Status: TestPass})
+
+	verdict, err := cachedVerdict(history, "e2e.yml", templates[0], "TestNetworkExternalLb")
+	assert.NoError(t, err)
+	assert.Equal(t, bisectBad, verdict)
+
+	for _, c := range []struct{ config, template, pattern string }{
+		{"other.yml", templates[0], "TestNetworkExternalLb"},
+		{"e2e.yml", templates[1], "TestNetworkExternalLb"},
+		{"e2e.yml", templates[0], "TestServices"},
+	} {
+		verdict, err := cachedVerdict(history, c.config, c.template, c.pattern)
+		assert.NoError(t, err)
+		assert.Equal(t, "", verdict, "%v", c)
+	}
+}
+
+func TestBisectConfig(t *testing.T) {
+	config := &Config{
+		Environment: testEnvironmentConfig(),
+		Env:         map[string]EnvValue{"SUITE": {Value: "smoke"}},
+		Artifacts:   "artifacts",
+	}
+	c := bisectConfig(config, 3, "https://example.com/3.json", "TestNetworkExternalLb")
+	assert.Equal(t, "https://example.com/3.json", c.Environment.Template)
+	assert.Equal(t, "TestNetworkExternalLb", c.Env[testRunVar].Value)
+	assert.Equal(t, "smoke", c.Env["SUITE"].Value)
+	assert.Equal(t, filepath.Join("artifacts", "bisect-03"), c.Artifacts)
+
+	assert.NotEqual(t, "https://example.com/3.json", config.Environment.Template)
+	assert.NotContains(t, config.Env, testRunVar)
+}
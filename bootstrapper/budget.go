@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// usageRetention is how long the usage of deleted stacks is remembered.
+const usageRetention = 48 * time.Hour
+
+// reservationTTL is how long a reservation holds resources for a stack being
+// created, should its bootstrapper die before the stack is.
+const reservationTTL = 10 * time.Minute
+
+// budgetPollInterval is how often a run waiting for resources checks again.
+var budgetPollInterval = time.Minute
+
+// Budget limits the resources used by e2e runs, so a runaway CI job can't
+// pile up environments.
+type Budget struct {
+	// MaxStacks is how many e2e stacks may exist at once in the account.
+	MaxStacks int `yaml:"max_stacks,omitempty"`
+	// MaxInstanceHours is how many instance-hours the stacks created from
+	// this machine may use per day. Stacks are counted from their creation
+	// to their deletion.
+	MaxInstanceHours float64 `yaml:"max_instance_hours,omitempty"`
+}
+
+// Usage records the lifetime of a stack, to account for instance-hours.
+type Usage struct {
+	StackID string `json:"stack_id"`
+	// Reservation identifies the usage of a stack being created, which has
+	// no ID yet. It counts against the budget until the stack is created.
+	Reservation string     `json:"reservation,omitempty"`
+	Instances   int        `json:"instances"`
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"`
+}
+
+// budgetError is returned when creating a stack would exceed the budget.
+// Unlike other errors, it goes away once other runs are done.
+type budgetError struct {
+	reason string
+}
+
+func (e *budgetError) Error() string {
+	return "over budget: " + e.reason
+}
+
+// budgetCloudFormation checks the budget and EC2 limits before creating
+// stacks, and records their usage in the state. The checks are done with the
+// state locked, along with a reservation for the stack, so that concurrent
+// bootstrappers can't all fit in the same room.
+type budgetCloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+
+	ec2    ec2iface.EC2API
+	store  *StateStore
+	budget *Budget
+	// wait is how long to wait for resources to be freed before refusing
+	// to create a stack.
+	wait time.Duration
+	// log is the logger of the run creating the stacks.
+	log *logrus.Entry
+}
+
+// withBudget returns cf, enforcing budget on stack creations.
+func withBudget(cf cloudformationiface.CloudFormationAPI, ec2 ec2iface.EC2API, store *StateStore, budget *Budget, wait time.Duration) cloudformationiface.CloudFormationAPI {
+	return &budgetCloudFormation{
+		CloudFormationAPI: cf,
+		ec2:               ec2,
+		store:             store,
+		budget:            budget,
+		wait:              wait,
+		log:               logrus.NewEntry(logrus.StandardLogger()),
+	}
+}
+
+func (b *budgetCloudFormation) CreateStack(input *cloudformation.CreateStackInput) (*cloudformation.CreateStackOutput, error) {
+	instances := stackInstances(input.Parameters)
+	hostname, _ := os.Hostname()
+	reservation := fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+
+	deadline := time.Now().Add(b.wait)
+	for {
+		err := b.store.Update(func(state *State) error {
+			if err := b.preflight(state, instances); err != nil {
+				return err
+			}
+			state.Usage = append(state.Usage, &Usage{
+				Reservation: reservation,
+				Instances:   instances,
+				Start:       time.Now(),
+			})
+			return nil
+		})
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*budgetError); !ok || time.Now().After(deadline) {
+			return nil, err
+		}
+		b.log.Warnf("Stack %s is queued, %v", aws.StringValue(input.StackName), err)
+		time.Sleep(budgetPollInterval)
+	}
+
+	output, err := b.CloudFormationAPI.CreateStack(input)
+	updateErr := b.store.Update(func(state *State) error {
+		usage := []*Usage{}
+		for _, u := range state.Usage {
+			if u.Reservation == reservation {
+				if err != nil {
+					continue
+				}
+				u.StackID = aws.StringValue(output.StackId)
+				u.Reservation = ""
+				u.Start = time.Now()
+			}
+			usage = append(usage, u)
+		}
+		state.Usage = usage
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if updateErr != nil {
+		// The stack exists regardless, don't make the run leak it.
+		b.log.Errorf("Unable to record the usage of %s: %v", aws.StringValue(output.StackId), updateErr)
+	}
+	return output, nil
+}
+
+// preflight checks that a stack of the given number of instances can be
+// created, given the stacks being created by others in state.
+func (b *budgetCloudFormation) preflight(state *State, instances int) error {
+	now := time.Now()
+	reservedStacks, reservedInstances := reservations(state, now)
+
+	if b.budget.MaxStacks > 0 {
+		count, err := b.countStacks()
+		if err != nil {
+			return err
+		}
+		count += reservedStacks
+		if count >= b.budget.MaxStacks {
+			return &budgetError{fmt.Sprintf("%d e2e stacks exist, the budget allows %d", count, b.budget.MaxStacks)}
+		}
+	}
+
+	if b.budget.MaxInstanceHours > 0 {
+		used := b.instanceHours(state, now)
+		// Instances are billed at least an hour.
+		if used+float64(instances) > b.budget.MaxInstanceHours {
+			return &budgetError{fmt.Sprintf("%.1f instance-hours used today, the stack needs at least %d more, the budget allows %.1f",
+				used, instances, b.budget.MaxInstanceHours)}
+		}
+	}
+
+	if b.ec2 != nil {
+		running, limit, err := b.instanceLimit()
+		if err != nil {
+			return err
+		}
+		running += reservedInstances
+		if limit > 0 && running+instances > limit {
+			return &budgetError{fmt.Sprintf("%d instances running, the stack needs %d more, the EC2 limit is %d", running, instances, limit)}
+		}
+	}
+	return nil
+}
+
+// reservations drops the expired reservations of state, and returns how many
+// stacks and instances the others hold.
+func reservations(state *State, now time.Time) (stacks int, instances int) {
+	usage := []*Usage{}
+	for _, u := range state.Usage {
+		if u.Reservation != "" {
+			if now.Sub(u.Start) > reservationTTL {
+				continue
+			}
+			stacks++
+			instances += u.Instances
+		}
+		usage = append(usage, u)
+	}
+	state.Usage = usage
+	return stacks, instances
+}
+
+// countStacks returns the number of e2e stacks, whoever created them.
+func (b *budgetCloudFormation) countStacks() (int, error) {
+	count := 0
+	err := b.DescribeStacksPages(&cloudformation.DescribeStacksInput{}, func(page *cloudformation.DescribeStacksOutput, lastPage bool) bool {
+		for _, s := range page.Stacks {
+			if aws.StringValue(s.StackStatus) == cloudformation.StackStatusDeleteComplete {
+				continue
+			}
+			for _, tag := range s.Tags {
+				if aws.StringValue(tag.Key) == "docker" && aws.StringValue(tag.Value) == "e2e" {
+					count++
+					break
+				}
+			}
+		}
+		return true
+	})
+	return count, err
+}
+
+// instanceHours returns the instance-hours used in state since the beginning
+// of the day of now. Deleted stacks are looked up to close their usage.
+func (b *budgetCloudFormation) instanceHours(state *State, now time.Time) float64 {
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	hours := 0.0
+	usage := []*Usage{}
+	for _, u := range state.Usage {
+		if u.End == nil && u.StackID != "" {
+			u.End = b.stackDeletion(u.StackID)
+		}
+		if u.End != nil && now.Sub(*u.End) > usageRetention {
+			continue
+		}
+		usage = append(usage, u)
+
+		start, end := u.Start, now
+		if u.End != nil {
+			end = *u.End
+		}
+		if start.Before(dayStart) {
+			start = dayStart
+		}
+		if end.After(start) {
+			hours += float64(u.Instances) * end.Sub(start).Hours()
+		}
+	}
+	state.Usage = usage
+	return hours
+}
+
+// stackDeletion returns when a stack was deleted, or nil if it still exists.
+func (b *budgetCloudFormation) stackDeletion(id string) *time.Time {
+	output, err := b.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(id),
+	})
+	if err != nil || len(output.Stacks) != 1 {
+		// Keep counting the stack until we know better.
+		return nil
+	}
+	s := output.Stacks[0]
+	if aws.StringValue(s.StackStatus) != cloudformation.StackStatusDeleteComplete {
+		return nil
+	}
+	if s.DeletionTime != nil {
+		return s.DeletionTime
+	}
+	return aws.Time(time.Now())
+}
+
+// instanceLimit returns the number of running instances of the account, and
+// how many it may run.
+func (b *budgetCloudFormation) instanceLimit() (running int, limit int, err error) {
+	attributes, err := b.ec2.DescribeAccountAttributes(&ec2.DescribeAccountAttributesInput{
+		AttributeNames: []*string{aws.String("max-instances")},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, a := range attributes.AccountAttributes {
+		if aws.StringValue(a.AttributeName) != "max-instances" || len(a.AttributeValues) == 0 {
+			continue
+		}
+		if limit, err = strconv.Atoi(aws.StringValue(a.AttributeValues[0].AttributeValue)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = b.ec2.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: []*string{aws.String("pending"), aws.String("running")},
+		}},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			running += len(r.Instances)
+		}
+		return true
+	})
+	return running, limit, err
+}
+
+// stackInstances returns the number of instances of a stack created with
+// params.
+func stackInstances(params []*cloudformation.Parameter) int {
+	instances := 0
+	for _, p := range params {
+		switch aws.StringValue(p.ParameterKey) {
+		case "ClusterSize", "ManagerSize":
+			n, _ := strconv.Atoi(aws.StringValue(p.ParameterValue))
+			instances += n
+		}
+	}
+	return instances
+}
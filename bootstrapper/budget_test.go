@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 reports a fixed instance limit and running instances.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	Limit   int
+	Running int
+}
+
+func (f *fakeEC2) DescribeAccountAttributes(input *ec2.DescribeAccountAttributesInput) (*ec2.DescribeAccountAttributesOutput, error) {
+	return &ec2.DescribeAccountAttributesOutput{
+		AccountAttributes: []*ec2.AccountAttribute{{
+			AttributeName:   aws.String("max-instances"),
+			AttributeValues: []*ec2.AccountAttributeValue{{AttributeValue: aws.String(strconv.Itoa(f.Limit))}},
+		}},
+	}, nil
+}
+
+func (f *fakeEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	reservation := &ec2.Reservation{}
+	for i := 0; i < f.Running; i++ {
+		reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: aws.String("i-" + strconv.Itoa(i))})
+	}
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, true)
+	return nil
+}
+
+func tempStateStore(t *testing.T) (*StateStore, func()) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStateStore(filepath.Join(dir, "state.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestBudgetMaxStacks(t *testing.T) {
+	store, cleanup := tempStateStore(t)
+	defer cleanup()
+	fake := newFakeCloudFormation()
+	fake.AddStack("production", cloudformation.StackStatusCreateComplete, time.Now())
+	cf := withBudget(fake, nil, store, &Budget{MaxStacks: 2}, 0)
+
+	first, err := provisionEnvironment(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.IsType(t, &budgetError{}, err)
+
+	state, err := store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Usage, 2)
+	assert.Equal(t, first.id, state.Usage[0].StackID)
+	assert.Equal(t, 8, state.Usage[0].Instances)
+
+	// Queued runs go on once a stack is deleted.
+	budgetPollInterval = time.Millisecond
+	cf = withBudget(fake, nil, store, &Budget{MaxStacks: 2}, time.Minute)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		first.Destroy()
+	}()
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+}
+
+// slowCloudFormation takes a while to create stacks, failing with Err if set.
+type slowCloudFormation struct {
+	*fakeCloudFormation
+	Err error
+}
+
+func (f *slowCloudFormation) CreateStack(input *cloudformation.CreateStackInput) (*cloudformation.CreateStackOutput, error) {
+	time.Sleep(50 * time.Millisecond)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.fakeCloudFormation.CreateStack(input)
+}
+
+func TestBudgetConcurrentRuns(t *testing.T) {
+	store, cleanup := tempStateStore(t)
+	defer cleanup()
+	fake := &slowCloudFormation{fakeCloudFormation: newFakeCloudFormation()}
+
+	// As two bootstrappers on the same machine.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		cf := withBudget(fake, nil, store, &Budget{MaxStacks: 1}, 0)
+		go func() {
+			_, err := provisionEnvironment(cf, testEnvironmentConfig())
+			errs <- err
+		}()
+	}
+	first, second := <-errs, <-errs
+	if first == nil {
+		first, second = second, first
+	}
+	assert.IsType(t, &budgetError{}, first, "the budget must hold across bootstrappers")
+	assert.NoError(t, second)
+
+	state, err := store.Load()
+	assert.NoError(t, err)
+	if assert.Len(t, state.Usage, 1) {
+		assert.NotEmpty(t, state.Usage[0].StackID)
+		assert.Empty(t, state.Usage[0].Reservation)
+	}
+}
+
+func TestBudgetReservations(t *testing.T) {
+	store, cleanup := tempStateStore(t)
+	defer cleanup()
+	fake := &slowCloudFormation{fakeCloudFormation: newFakeCloudFormation(), Err: errors.New("throttled")}
+	cf := withBudget(fake, nil, store, &Budget{MaxStacks: 1}, 0)
+
+	_, err := provisionEnvironment(cf, testEnvironmentConfig())
+	assert.Error(t, err)
+	state, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, state.Usage, "the reservation of a failed creation must be dropped")
+
+	// The reservation of a bootstrapper which died is eventually dropped.
+	store.Update(func(state *State) error {
+		state.Usage = []*Usage{{Reservation: "dead", Instances: 8, Start: time.Now().Add(-reservationTTL - time.Minute)}}
+		return nil
+	})
+	fake.Err = nil
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+	state, err = store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Usage, 1)
+}
+
+func TestBudgetInstanceHours(t *testing.T) {
+	store, cleanup := tempStateStore(t)
+	defer cleanup()
+	fake := newFakeCloudFormation()
+	now := time.Now()
+	noon := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, now.Location())
+
+	running := fake.AddStack("docker-e2e-20160928-0", cloudformation.StackStatusCreateComplete, noon.Add(-2*time.Hour))
+	deleted := fake.AddStack("docker-e2e-20160928-1", cloudformation.StackStatusCreateComplete, noon.Add(-14*time.Hour))
+	fake.DeleteStack(&cloudformation.DeleteStackInput{StackName: aws.String(deleted)})
+	store.Update(func(state *State) error {
+		state.Usage = []*Usage{
+			{StackID: running, Instances: 8, Start: noon.Add(-2 * time.Hour)},
+			// Started yesterday, only half a day counts.
+			{StackID: deleted, Instances: 2, Start: noon.Add(-14 * time.Hour), End: aws.Time(noon.Add(-6 * time.Hour))},
+			// Forgotten after a while.
+			{StackID: "old", Instances: 8, Start: noon.Add(-72 * time.Hour), End: aws.Time(noon.Add(-71 * time.Hour))},
+		}
+		return nil
+	})
+
+	cf := withBudget(fake, nil, store, &Budget{MaxInstanceHours: 20}, 0).(*budgetCloudFormation)
+	var hours float64
+	assert.NoError(t, store.Update(func(state *State) error {
+		hours = cf.instanceHours(state, noon)
+		return nil
+	}))
+	assert.InDelta(t, 8*2+2*6, hours, 0.01)
+
+	state, err := store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Usage, 2, "old usage must be pruned")
+
+	// Instances count for at least an hour.
+	cf = withBudget(newFakeCloudFormation(), nil, store, &Budget{MaxInstanceHours: 7}, 0).(*budgetCloudFormation)
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.IsType(t, &budgetError{}, err)
+}
+
+func TestBudgetEC2Limit(t *testing.T) {
+	store, cleanup := tempStateStore(t)
+	defer cleanup()
+	ec2 := &fakeEC2{Limit: 20, Running: 10}
+	cf := withBudget(newFakeCloudFormation(), ec2, store, &Budget{}, 0)
+
+	_, err := provisionEnvironment(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+
+	ec2.Running = 15
+	_, err = provisionEnvironment(cf, testEnvironmentConfig())
+	assert.IsType(t, &budgetError{}, err)
+	assert.Contains(t, err.Error(), "EC2 limit is 20")
+}
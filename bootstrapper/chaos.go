@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Chaos actions.
+const (
+	chaosRebootNode = "reboot-node"
+	chaosStopDocker = "stop-docker"
+	chaosPartition  = "partition"
+	chaosDrainNode  = "drain-node"
+	chaosKillLeader = "kill-leader"
+	// chaosRestore undoes the previous actions without waiting for the end
+	// of the commands.
+	chaosRestore = "restore"
+)
+
+var chaosActions = []string{chaosRebootNode, chaosStopDocker, chaosPartition, chaosDrainNode, chaosKillLeader, chaosRestore}
+
+// Node roles.
+const (
+	roleManager = "manager"
+	roleWorker  = "worker"
+)
+
+// defaultChaosTimeout is how long restoring waits for the nodes to be ready.
+const defaultChaosTimeout = 5 * time.Minute
+
+// chaosPollInterval is how often the nodes are checked while restoring.
+var chaosPollInterval = 5 * time.Second
+
+// Commands run on the nodes by the actions. They expect passwordless sudo,
+// and systemd or an init script for docker.
+const (
+	stopDockerCmd  = "sudo systemctl stop docker || sudo service docker stop"
+	startDockerCmd = "sudo systemctl start docker || sudo service docker start"
+	killDockerCmd  = "sudo pkill -9 dockerd"
+	// The reboot is delayed so that the session ends cleanly.
+	rebootCmd = "sudo sh -c 'sleep 1; reboot' >/dev/null 2>&1 &"
+)
+
+// listNodesCmd prints "ID ROLE ADDRESS LEADER HOSTNAME" for every node.
+const listNodesCmd = `docker node inspect --format '{{.ID}} {{.Spec.Role}} {{.Status.Addr}} {{if .ManagerStatus}}{{.ManagerStatus.Leader}}{{else}}false{{end}} {{.Description.Hostname}}' $(docker node ls -q)`
+
+// Chaos degrades the swarm, so that the following commands run on a cluster
+// in trouble. Whatever it did is undone once the commands are done, or at a
+// restore action.
+//
+//	commands:
+//	  - chaos: {action: stop-docker, target: {role: worker, index: 0}}
+//	  - go test -v ./tests
+type Chaos struct {
+	// Action is one of reboot-node, stop-docker, partition, drain-node,
+	// kill-leader and restore.
+	Action string `yaml:"action"`
+	// Target selects the nodes the action applies to. kill-leader ignores
+	// it. reboot-node and stop-docker refuse the manager the bootstrapper is
+	// connected to, whose docker runs the tests. kill-leader connects to
+	// another manager first if it is the leader, it needs more than one.
+	Target NodeSelector `yaml:"target,omitempty"`
+	// Peers are the nodes partition cuts the targets from, all the others by
+	// default.
+	Peers *NodeSelector `yaml:"peers,omitempty"`
+	// Timeout is how long restoring waits for the nodes to be ready again,
+	// 5m by default.
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// NodeSelector selects nodes of the swarm by role (manager or worker, any by
+// default) and by index among the nodes of that role sorted by hostname (all
+// by default).
+type NodeSelector struct {
+	Role  string `yaml:"role,omitempty"`
+	Index *int   `yaml:"index,omitempty"`
+}
+
+func (s NodeSelector) String() string {
+	role := s.Role
+	if role == "" {
+		role = "node"
+	}
+	if s.Index == nil {
+		return "all " + role + "s"
+	}
+	return fmt.Sprintf("%s %d", role, *s.Index)
+}
+
+func (c *Chaos) String() string {
+	switch c.Action {
+	case chaosKillLeader, chaosRestore:
+		return "chaos " + c.Action
+	case chaosPartition:
+		peers := "the other nodes"
+		if c.Peers != nil {
+			peers = c.Peers.String()
+		}
+		return fmt.Sprintf("chaos %s %s from %s", c.Action, c.Target, peers)
+	}
+	return fmt.Sprintf("chaos %s %s", c.Action, c.Target)
+}
+
+func (c *Chaos) problems(path string) []string {
+	problems := []string{}
+	valid := false
+	for _, a := range chaosActions {
+		valid = valid || c.Action == a
+	}
+	if !valid {
+		problems = append(problems, fmt.Sprintf("%s.action: must be one of %s, got %q", path, strings.Join(chaosActions, ", "), c.Action))
+	}
+	problems = append(problems, c.Target.problems(path+".target")...)
+	if c.Peers != nil {
+		if c.Action != chaosPartition {
+			problems = append(problems, fmt.Sprintf("%s.peers: only valid for %s", path, chaosPartition))
+		}
+		problems = append(problems, c.Peers.problems(path+".peers")...)
+	}
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.timeout: invalid duration %q", path, c.Timeout))
+		}
+	}
+	return problems
+}
+
+func (s NodeSelector) problems(path string) []string {
+	problems := []string{}
+	if s.Role != "" && s.Role != roleManager && s.Role != roleWorker {
+		problems = append(problems, fmt.Sprintf("%s.role: must be %s or %s, got %q", path, roleManager, roleWorker, s.Role))
+	}
+	if s.Index != nil && *s.Index < 0 {
+		problems = append(problems, fmt.Sprintf("%s.index: must not be negative", path))
+	}
+	return problems
+}
+
+func (c *Chaos) timeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+	return defaultChaosTimeout
+}
+
+// swarmNode is a node of the swarm, as listed by listNodesCmd.
+type swarmNode struct {
+	ID       string
+	Role     string
+	Addr     string
+	Leader   bool
+	Hostname string
+}
+
+func (n swarmNode) String() string {
+	return fmt.Sprintf("%s %s (%s)", n.Role, n.Hostname, n.Addr)
+}
+
+// parseNodes parses the output of listNodesCmd, sorted by role and hostname.
+func parseNodes(output string) ([]swarmNode, error) {
+	nodes := []swarmNode{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, errors.Errorf("unexpected node %q", line)
+		}
+		nodes = append(nodes, swarmNode{
+			ID:       fields[0],
+			Role:     fields[1],
+			Addr:     fields[2],
+			Leader:   fields[3] == "true",
+			Hostname: fields[4],
+		})
+	}
+	sort.Sort(byRoleAndHostname(nodes))
+	return nodes, nil
+}
+
+type byRoleAndHostname []swarmNode
+
+func (b byRoleAndHostname) Len() int      { return len(b) }
+func (b byRoleAndHostname) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRoleAndHostname) Less(i, j int) bool {
+	if b[i].Role != b[j].Role {
+		return b[i].Role < b[j].Role
+	}
+	return b[i].Hostname < b[j].Hostname
+}
+
+// selectNodes returns the nodes matching the selector.
+func (s NodeSelector) selectNodes(nodes []swarmNode) ([]swarmNode, error) {
+	matching := []swarmNode{}
+	for _, n := range nodes {
+		if s.Role == "" || n.Role == s.Role {
+			matching = append(matching, n)
+		}
+	}
+	if s.Index != nil {
+		if *s.Index >= len(matching) {
+			return nil, errors.Errorf("no %s, there are %d", s, len(matching))
+		}
+		matching = matching[*s.Index : *s.Index+1]
+	}
+	if len(matching) == 0 {
+		return nil, errors.Errorf("no %s", s)
+	}
+	return matching, nil
+}
+
+// chaosCluster runs the commands of the chaos actions.
+type chaosCluster interface {
+	// manager runs cmd on the manager the bootstrapper is connected to.
+	manager(cmd string) (string, error)
+	// node runs cmd on the node at addr.
+	node(addr, cmd string) (string, error)
+	// connect makes the manager at addr the one the bootstrapper is
+	// connected to.
+	connect(addr string) error
+}
+
+// environmentCluster runs the commands of the chaos actions on an
+// environment.
+type environmentCluster struct {
+	env *Environment
+}
+
+// manager returns the standard output of cmd, or its standard error if it
+// fails.
+func (c environmentCluster) manager(cmd string) (string, error) {
+	result, err := c.env.Run(cmd, nil, nil, nil)
+	if err != nil {
+		return string(result.Stderr), err
+	}
+	return string(result.Stdout), nil
+}
+
+func (c environmentCluster) connect(addr string) error {
+	return c.env.ConnectNode(addr)
+}
+
+func (c environmentCluster) node(addr, cmd string) (string, error) {
+	client, err := c.env.DialNode(addr)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(cmd)
+	return string(output), err
+}
+
+// chaosMonkey applies chaos actions and undoes them.
+type chaosMonkey struct {
+	cluster chaosCluster
+	// self is the ID of the node the bootstrapper is connected to.
+	self string
+	// undo restores what the applied actions did, most recent last.
+	undo []func(out io.Writer) error
+	// log is the logger of the run.
+	log *logrus.Entry
+	// connected is called once the bootstrapper connected to another
+	// manager, to set it up as the first one.
+	connected func() error
+}
+
+func newChaosMonkey(cluster chaosCluster) *chaosMonkey {
+	return &chaosMonkey{cluster: cluster, log: logrus.NewEntry(logrus.StandardLogger())}
+}
+
+// say logs what the monkey does, and writes it to out.
+func (m *chaosMonkey) say(out io.Writer, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	m.log.Info("==> " + msg)
+	if out != nil {
+		fmt.Fprintln(out, msg)
+	}
+}
+
+func (m *chaosMonkey) nodes() ([]swarmNode, error) {
+	if m.self == "" {
+		output, err := m.cluster.manager("docker info --format '{{.Swarm.NodeID}}'")
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to identify the manager: %s", output)
+		}
+		m.self = strings.TrimSpace(output)
+	}
+	output, err := m.cluster.manager(listNodesCmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the nodes: %s", output)
+	}
+	return parseNodes(output)
+}
+
+// run runs cmd on a node, failing with its output.
+func (m *chaosMonkey) run(n swarmNode, cmd string) error {
+	output, err := m.cluster.node(n.Addr, cmd)
+	if err != nil {
+		return errors.Wrapf(err, "%s on %s: %s", cmd, n, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// leave connects the bootstrapper to another manager than self, so that it
+// survives the action on self.
+func (m *chaosMonkey) leave(out io.Writer, nodes []swarmNode, self swarmNode) error {
+	for _, n := range nodes {
+		if n.Role != roleManager || n.ID == self.ID {
+			continue
+		}
+		m.say(out, "Connecting to %s instead of %s", n, self)
+		if err := m.cluster.connect(n.Addr); err != nil {
+			return errors.Wrapf(err, "unable to connect to %s", n)
+		}
+		m.self = n.ID
+		if m.connected != nil {
+			return m.connected()
+		}
+		return nil
+	}
+	return errors.Errorf("%s is the only manager, the bootstrapper is connected to it", self)
+}
+
+// checkNotSelf fails if one of the targets is the node the bootstrapper is
+// connected to: the tests run against its docker, so the action would stop
+// them rather than degrade the cluster. what describes the action on a node.
+func (m *chaosMonkey) checkNotSelf(targets []swarmNode, what string) error {
+	for _, n := range targets {
+		if n.ID == m.self {
+			return errors.Errorf("can't %s, the bootstrapper is connected to it", fmt.Sprintf(what, n))
+		}
+	}
+	return nil
+}
+
+// apply runs a chaos action, writing what it does to out.
+func (m *chaosMonkey) apply(c *Chaos, out io.Writer) error {
+	if c.Action == chaosRestore {
+		return m.restore(out)
+	}
+
+	nodes, err := m.nodes()
+	if err != nil {
+		return err
+	}
+	var targets []swarmNode
+	if c.Action == chaosKillLeader {
+		for _, n := range nodes {
+			if n.Leader {
+				targets = append(targets, n)
+			}
+		}
+		if len(targets) == 0 {
+			return errors.New("no leader")
+		}
+		if targets[0].ID == m.self {
+			if err := m.leave(out, nodes, targets[0]); err != nil {
+				return err
+			}
+		}
+	} else if targets, err = c.Target.selectNodes(nodes); err != nil {
+		return err
+	}
+
+	switch c.Action {
+	case chaosStopDocker, chaosKillLeader:
+		cmd := stopDockerCmd
+		if c.Action == chaosKillLeader {
+			cmd = killDockerCmd
+		}
+		if err := m.checkNotSelf(targets, "stop docker on %s"); err != nil {
+			return err
+		}
+		for _, n := range targets {
+			m.say(out, "Stopping docker on %s", n)
+			if err := m.run(n, cmd); err != nil {
+				return err
+			}
+			n := n
+			m.undo = append(m.undo, func(out io.Writer) error {
+				m.say(out, "Starting docker on %s", n)
+				if err := m.run(n, startDockerCmd); err != nil {
+					return err
+				}
+				return m.waitNodes(out, []swarmNode{n}, true, c.timeout())
+			})
+		}
+
+	case chaosRebootNode:
+		if err := m.checkNotSelf(targets, "reboot %s"); err != nil {
+			return err
+		}
+		for _, n := range targets {
+			m.say(out, "Rebooting %s", n)
+			if err := m.run(n, rebootCmd); err != nil {
+				return err
+			}
+			n := n
+			m.undo = append(m.undo, func(out io.Writer) error {
+				return m.waitNodes(out, []swarmNode{n}, true, c.timeout())
+			})
+		}
+		// Until the manager notices, the nodes still look ready.
+		if err := m.waitNodes(out, targets, false, c.timeout()); err != nil {
+			return err
+		}
+
+	case chaosDrainNode:
+		for _, n := range targets {
+			m.say(out, "Draining %s", n)
+			if output, err := m.cluster.manager("docker node update --availability drain " + n.ID); err != nil {
+				return errors.Wrapf(err, "unable to drain %s: %s", n, output)
+			}
+			n := n
+			m.undo = append(m.undo, func(out io.Writer) error {
+				m.say(out, "Activating %s", n)
+				if output, err := m.cluster.manager("docker node update --availability active " + n.ID); err != nil {
+					return errors.Wrapf(err, "unable to activate %s: %s", n, output)
+				}
+				return nil
+			})
+		}
+
+	case chaosPartition:
+		return m.partition(c, nodes, targets, out)
+	}
+	return nil
+}
+
+// partition drops the traffic between the targets and their peers.
+func (m *chaosMonkey) partition(c *Chaos, nodes, targets []swarmNode, out io.Writer) error {
+	var peers []swarmNode
+	if c.Peers != nil {
+		var err error
+		if peers, err = c.Peers.selectNodes(nodes); err != nil {
+			return err
+		}
+	} else {
+		for _, n := range nodes {
+			if !containsNode(targets, n) {
+				peers = append(peers, n)
+			}
+		}
+	}
+
+	for _, t := range targets {
+		for _, p := range peers {
+			if t.ID == p.ID {
+				continue
+			}
+			// The rules are set on the target, unless the peer is the node
+			// the bootstrapper is connected to: the target would then be
+			// unreachable to remove them.
+			host, other := t, p
+			if p.ID == m.self {
+				host, other = p, t
+			}
+			m.say(out, "Dropping the traffic between %s and %s", t, p)
+			if err := m.run(host, iptablesRules("-I", other.Addr)); err != nil {
+				return err
+			}
+			m.undo = append(m.undo, func(out io.Writer) error {
+				m.say(out, "Restoring the traffic between %s and %s", host, other)
+				return m.run(host, iptablesRules("-D", other.Addr))
+			})
+		}
+	}
+	return nil
+}
+
+// iptablesRules returns the command inserting (-I) or deleting (-D) the
+// rules dropping the traffic with addr.
+func iptablesRules(op, addr string) string {
+	return fmt.Sprintf("sudo iptables %s INPUT -s %s -j DROP && sudo iptables %s OUTPUT -d %s -j DROP", op, addr, op, addr)
+}
+
+func containsNode(nodes []swarmNode, n swarmNode) bool {
+	for _, o := range nodes {
+		if o.ID == n.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// waitNodes waits for nodes to be ready, or all not to be if ready is false.
+func (m *chaosMonkey) waitNodes(out io.Writer, nodes []swarmNode, ready bool, timeout time.Duration) error {
+	ids := []string{}
+	for _, n := range nodes {
+		ids = append(ids, n.ID)
+	}
+	state, want := "ready", len(ids)
+	if !ready {
+		state, want = "down", 0
+	}
+	m.say(out, "Waiting for %d nodes to be %s", len(nodes), state)
+	cmd := "docker node inspect --format '{{.Status.State}}' " + strings.Join(ids, " ")
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := m.cluster.manager(cmd)
+		if err == nil && strings.Count(output, "ready") == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("nodes %s not %s after %v: %s", strings.Join(ids, ", "), state, timeout, strings.TrimSpace(output))
+		}
+		time.Sleep(chaosPollInterval)
+	}
+}
+
+// restore undoes the applied actions, most recent first. It goes on after
+// failures, and returns the first one.
+func (m *chaosMonkey) restore(out io.Writer) error {
+	var first error
+	for i := len(m.undo) - 1; i >= 0; i-- {
+		if err := m.undo[i](out); err != nil {
+			m.log.Errorf("Unable to restore the cluster: %v", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	m.undo = nil
+	return first
+}
+
+// runChaosStep applies a chaos action as a step of the run, saving what it
+// did like the output of a command.
+func runChaosStep(m *chaosMonkey, cfg *Config, artifacts *Artifacts, name string, c *Chaos) (*Result, error) {
+	stdoutLog, stderrLog, err := artifacts.Output(name)
+	if err != nil {
+		return nil, err
+	}
+	if stdoutLog != nil {
+		defer stdoutLog.Close()
+		defer stderrLog.Close()
+	}
+
+	var buf bytes.Buffer
+	writers := []io.Writer{&buf}
+	if stdoutLog != nil {
+		writers = append(writers, stdoutLog)
+	}
+	if cfg.output != nil {
+		fmt.Fprintf(cfg.output, "$ %s\n", c)
+		writers = append(writers, cfg.output)
+	}
+
+	result := &Result{Command: c.String()}
+	if stdoutLog != nil {
+		result.Logs = artifacts.Path(name)
+	}
+	start := time.Now()
+	err = m.apply(c, multiWriter(writers...))
+	result.Duration = time.Since(start)
+	result.Stdout = buf.Bytes()
+	if err != nil {
+		result.ExitStatus = 1
+		result.Stderr = []byte(err.Error() + "\n")
+		if stderrLog != nil {
+			stderrLog.Write(result.Stderr)
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCluster is a swarm of two managers and two workers, recording the
+// commands of the chaos actions.
+type fakeCluster struct {
+	mu       sync.Mutex
+	commands []string
+	// self is the node the bootstrapper is connected to, m1 by default.
+	self string
+	// notReady lists the nodes reported down until polled that many times.
+	notReady map[string]int
+	// readyFor lists the nodes still reported ready that many times, before
+	// notReady applies.
+	readyFor map[string]int
+	fail     map[string]bool
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{self: "m1", notReady: make(map[string]int), readyFor: make(map[string]int), fail: make(map[string]bool)}
+}
+
+func (c *fakeCluster) manager(cmd string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case strings.HasPrefix(cmd, "docker info"):
+		return c.self + "\n", nil
+	case cmd == listNodesCmd:
+		return "w2 worker 10.0.2.2 false ip-10-0-2-2\n" +
+			"m1 manager 10.0.1.1 true ip-10-0-1-1\n" +
+			"w1 worker 10.0.2.1 false ip-10-0-2-1\n" +
+			"m2 manager 10.0.1.2 false ip-10-0-1-2\n", nil
+	case strings.Contains(cmd, "{{.Status.State}}"):
+		states := []string{}
+		for _, id := range strings.Fields(cmd)[5:] {
+			if c.readyFor[id] > 0 {
+				c.readyFor[id]--
+				states = append(states, "ready")
+			} else if c.notReady[id] > 0 {
+				c.notReady[id]--
+				states = append(states, "down")
+			} else {
+				states = append(states, "ready")
+			}
+		}
+		return strings.Join(states, "\n") + "\n", nil
+	}
+	c.commands = append(c.commands, "manager: "+cmd)
+	return "", nil
+}
+
+func (c *fakeCluster) node(addr, cmd string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, addr+": "+cmd)
+	if c.fail[addr] {
+		return "sudo: a password is required", fmt.Errorf("exit status 1")
+	}
+	return "", nil
+}
+
+func (c *fakeCluster) connect(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, "connect "+addr)
+	if c.fail[addr] {
+		return fmt.Errorf("connection refused")
+	}
+	c.self = map[string]string{"10.0.1.1": "m1", "10.0.1.2": "m2"}[addr]
+	return nil
+}
+
+func (c *fakeCluster) Commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	commands := c.commands
+	c.commands = nil
+	return commands
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := parseNodes("w1 worker 10.0.2.1 false ip-b\nm1 manager 10.0.1.1 true ip-c\nw2 worker 10.0.2.2 false ip-a\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []swarmNode{
+		{ID: "m1", Role: roleManager, Addr: "10.0.1.1", Leader: true, Hostname: "ip-c"},
+		{ID: "w2", Role: roleWorker, Addr: "10.0.2.2", Hostname: "ip-a"},
+		{ID: "w1", Role: roleWorker, Addr: "10.0.2.1", Hostname: "ip-b"},
+	}, nodes)
+
+	workers, err := NodeSelector{Role: roleWorker}.selectNodes(nodes)
+	assert.NoError(t, err)
+	assert.Len(t, workers, 2)
+	second, err := NodeSelector{Role: roleWorker, Index: intPtr(1)}.selectNodes(nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, "w1", second[0].ID)
+	_, err = NodeSelector{Role: roleManager, Index: intPtr(1)}.selectNodes(nodes)
+	assert.EqualError(t, err, "no manager 1, there are 1")
+
+	_, err = parseNodes("Error response from daemon: This node is not a swarm manager.")
+	assert.Error(t, err)
+}
+
+func TestChaosProblems(t *testing.T) {
+	assert.Empty(t, (&Chaos{Action: chaosPartition, Target: NodeSelector{Role: roleWorker}, Peers: &NodeSelector{Role: roleManager}}).problems("chaos"))
+	assert.Equal(t, []string{
+		`chaos.action: must be one of reboot-node, stop-docker, partition, drain-node, kill-leader, restore, got "unplug"`,
+		`chaos.target.role: must be manager or worker, got "leader"`,
+		"chaos.target.index: must not be negative",
+		"chaos.peers: only valid for partition",
+		`chaos.timeout: invalid duration "soon"`,
+	}, (&Chaos{
+		Action:  "unplug",
+		Target:  NodeSelector{Role: "leader", Index: intPtr(-1)},
+		Peers:   &NodeSelector{},
+		Timeout: "soon",
+	}).problems("chaos"))
+}
+
+func TestChaosStopDocker(t *testing.T) {
+	defer func(interval time.Duration) { chaosPollInterval = interval }(chaosPollInterval)
+	chaosPollInterval = time.Millisecond
+
+	cluster := newFakeCluster()
+	m := newChaosMonkey(cluster)
+	var out bytes.Buffer
+	assert.NoError(t, m.apply(&Chaos{Action: chaosStopDocker, Target: NodeSelector{Role: roleWorker, Index: intPtr(0)}}, &out))
+	assert.Equal(t, []string{"10.0.2.1: " + stopDockerCmd}, cluster.Commands())
+	assert.Equal(t, "Stopping docker on worker ip-10-0-2-1 (10.0.2.1)\n", out.String())
+
+	cluster.notReady["w1"] = 2
+	assert.NoError(t, m.restore(nil))
+	assert.Equal(t, []string{"10.0.2.1: " + startDockerCmd}, cluster.Commands())
+	assert.Equal(t, 0, cluster.notReady["w1"], "must wait for the node to be ready")
+
+	assert.NoError(t, m.restore(nil), "restoring twice must be a no-op")
+	assert.Empty(t, cluster.Commands())
+}
+
+func TestChaosActions(t *testing.T) {
+	defer func(interval time.Duration) { chaosPollInterval = interval }(chaosPollInterval)
+	chaosPollInterval = time.Millisecond
+
+	cluster := newFakeCluster()
+	cluster.self = "m2"
+	m := newChaosMonkey(cluster)
+
+	assert.NoError(t, m.apply(&Chaos{Action: chaosKillLeader}, nil))
+	assert.Equal(t, []string{"10.0.1.1: " + killDockerCmd}, cluster.Commands())
+
+	assert.NoError(t, m.apply(&Chaos{Action: chaosDrainNode, Target: NodeSelector{Role: roleManager, Index: intPtr(1)}}, nil))
+	assert.Equal(t, []string{"manager: docker node update --availability drain m2"}, cluster.Commands())
+
+	// The nodes still look ready for a while after the reboot.
+	for _, id := range []string{"w1", "w2"} {
+		cluster.readyFor[id], cluster.notReady[id] = 2, 1
+	}
+	var out bytes.Buffer
+	assert.NoError(t, m.apply(&Chaos{Action: chaosRebootNode, Target: NodeSelector{Role: roleWorker}}, &out))
+	assert.Equal(t, []string{"10.0.2.1: " + rebootCmd, "10.0.2.2: " + rebootCmd}, cluster.Commands())
+	assert.Contains(t, out.String(), "Waiting for 2 nodes to be down")
+	assert.Equal(t, 0, cluster.readyFor["w1"]+cluster.notReady["w1"], "must wait for the nodes to go down")
+	assert.EqualError(t, m.apply(&Chaos{Action: chaosRebootNode, Target: NodeSelector{Role: roleManager}}, nil),
+		"can't reboot manager ip-10-0-1-2 (10.0.1.2), the bootstrapper is connected to it")
+	assert.Empty(t, cluster.Commands(), "must not reboot the manager the bootstrapper is connected to")
+
+	assert.NoError(t, m.apply(&Chaos{Action: chaosRestore}, nil))
+	assert.Equal(t, []string{
+		"manager: docker node update --availability active m2",
+		"10.0.1.1: " + startDockerCmd,
+	}, cluster.Commands(), "must restore in reverse order")
+}
+
+func TestChaosSelf(t *testing.T) {
+	cluster := newFakeCluster()
+	m := newChaosMonkey(cluster)
+
+	// m1 is the manager the bootstrapper is connected to.
+	assert.EqualError(t, m.apply(&Chaos{Action: chaosStopDocker, Target: NodeSelector{Role: roleManager}}, nil),
+		"can't stop docker on manager ip-10-0-1-1 (10.0.1.1), the bootstrapper is connected to it")
+	assert.Empty(t, cluster.Commands(), "must not stop docker on the manager the bootstrapper is connected to")
+
+	// It is also the leader: the bootstrapper moves to m2 first.
+	cluster.fail["10.0.1.2"] = true
+	assert.Error(t, m.apply(&Chaos{Action: chaosKillLeader}, nil))
+	assert.Equal(t, []string{"connect 10.0.1.2"}, cluster.Commands(), "must not kill the leader if it can't move")
+	delete(cluster.fail, "10.0.1.2")
+
+	connected := 0
+	m.connected = func() error {
+		connected++
+		return nil
+	}
+	var out bytes.Buffer
+	assert.NoError(t, m.apply(&Chaos{Action: chaosKillLeader}, &out))
+	assert.Equal(t, []string{"connect 10.0.1.2", "10.0.1.1: " + killDockerCmd}, cluster.Commands())
+	assert.Contains(t, out.String(), "Connecting to manager ip-10-0-1-2 (10.0.1.2) instead of manager ip-10-0-1-1 (10.0.1.1)")
+	assert.Equal(t, 1, connected, "the new manager must be set up")
+	assert.Equal(t, "m2", m.self)
+
+	err := m.leave(nil, []swarmNode{{ID: "m1", Role: roleManager, Addr: "10.0.1.1", Hostname: "ip-10-0-1-1"}}, swarmNode{ID: "m1", Role: roleManager, Addr: "10.0.1.1", Hostname: "ip-10-0-1-1"})
+	assert.EqualError(t, err, "manager ip-10-0-1-1 (10.0.1.1) is the only manager, the bootstrapper is connected to it")
+}
+
+func TestKillLeaderProblems(t *testing.T) {
+	config := &Config{
+		Environment: &EnvironmentConfig{Managers: 1},
+		Commands:    []Command{{Run: "docker version"}, {Chaos: &Chaos{Action: chaosKillLeader}}},
+	}
+	assert.Equal(t, []string{"commands[1].chaos: kill-leader needs more than one manager"}, killLeaderProblems(config))
+
+	config.Matrix = &Matrix{Managers: []int{1, 3}}
+	assert.Equal(t, []string{"matrix template0-m1-w0-: commands[1].chaos: kill-leader needs more than one manager"}, killLeaderProblems(config))
+
+	config.Matrix = nil
+	config.Environment.Managers = 3
+	assert.Empty(t, killLeaderProblems(config))
+}
+
+func TestChaosPartition(t *testing.T) {
+	cluster := newFakeCluster()
+	m := newChaosMonkey(cluster)
+
+	assert.NoError(t, m.apply(&Chaos{Action: chaosPartition, Target: NodeSelector{Role: roleWorker, Index: intPtr(0)}}, nil))
+	assert.Equal(t, []string{
+		// m1 is the manager the bootstrapper is connected to, it drops the
+		// traffic so that the rules can be removed.
+		"10.0.1.1: " + iptablesRules("-I", "10.0.2.1"),
+		"10.0.2.1: " + iptablesRules("-I", "10.0.1.2"),
+		"10.0.2.1: " + iptablesRules("-I", "10.0.2.2"),
+	}, cluster.Commands())
+
+	assert.NoError(t, m.restore(nil))
+	assert.Equal(t, []string{
+		"10.0.2.1: " + iptablesRules("-D", "10.0.2.2"),
+		"10.0.2.1: " + iptablesRules("-D", "10.0.1.2"),
+		"10.0.1.1: " + iptablesRules("-D", "10.0.2.1"),
+	}, cluster.Commands())
+}
+
+func TestChaosRestoreFailure(t *testing.T) {
+	cluster := newFakeCluster()
+	m := newChaosMonkey(cluster)
+	assert.NoError(t, m.apply(&Chaos{Action: chaosDrainNode, Target: NodeSelector{Role: roleWorker, Index: intPtr(1)}}, nil))
+	assert.NoError(t, m.apply(&Chaos{Action: chaosStopDocker, Target: NodeSelector{Role: roleWorker, Index: intPtr(0)}}, nil))
+	cluster.Commands()
+
+	cluster.fail["10.0.2.1"] = true
+	err := m.restore(nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "sudo: a password is required")
+	assert.Equal(t, []string{
+		"10.0.2.1: " + startDockerCmd,
+		"manager: docker node update --availability active w2",
+	}, cluster.Commands(), "must go on after a failure")
+}
+
+func TestEnvironmentCluster(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+	cluster := environmentCluster{env}
+
+	output, err := cluster.manager("echo manager; echo warning >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "manager\n", output)
+	output, err = cluster.manager("echo not a swarm manager >&2; exit 1")
+	assert.Error(t, err)
+	assert.Equal(t, "not a swarm manager\n", output)
+
+	// The node is reached through the manager, here the same server.
+	output, err = cluster.node(server.Addr, "echo node")
+	assert.NoError(t, err)
+	assert.Equal(t, "node\n", output)
+}
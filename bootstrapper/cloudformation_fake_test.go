@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// fakeCloudFormation is an in-memory CloudFormation. Stacks complete their
+// operations instantly. Calling methods that are not implemented panics.
+type fakeCloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+
+	mu     sync.Mutex
+	stacks []*fakeStack
+	nextID int
+
+	// PageSize is the maximum number of items returned per page.
+	PageSize int
+	// Outputs returns the outputs of a new stack. By default stacks get an
+	// SSH output pointing to a fake ELB.
+	Outputs func(name string) map[string]string
+	// FailCreate makes the creation of the stacks with these names fail.
+	FailCreate map[string]bool
+	// FailUpdate makes all stack updates roll back.
+	FailUpdate bool
+}
+
+type fakeStack struct {
+	stack    *cloudformation.Stack
+	template string
+	deleted  *time.Time
+	events   []*cloudformation.StackEvent
+}
+
+func newFakeCloudFormation() *fakeCloudFormation {
+	return &fakeCloudFormation{
+		PageSize:   2,
+		FailCreate: make(map[string]bool),
+	}
+}
+
+// AddStack inserts a stack created at the given time, as if it had been
+// created by a previous run.
+func (f *fakeCloudFormation) AddStack(name, status string, created time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.newStack(name, "", created)
+	s.stack.StackStatus = aws.String(status)
+	return *s.stack.StackId
+}
+
+// Stack returns a stack by name or ID, including deleted ones.
+func (f *fakeCloudFormation) Stack(nameOrID string) *cloudformation.Stack {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s := f.find(nameOrID, true); s != nil {
+		return s.stack
+	}
+	return nil
+}
+
+// Template returns the template a stack was created or updated with.
+func (f *fakeCloudFormation) Template(nameOrID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s := f.find(nameOrID, true); s != nil {
+		return s.template
+	}
+	return ""
+}
+
+func (f *fakeCloudFormation) newStack(name, template string, created time.Time) *fakeStack {
+	f.nextID++
+	id := fmt.Sprintf("arn:aws:cloudformation:us-east-1:123456789012:stack/%s/%d", name, f.nextID)
+
+	outputs := map[string]string{
+		"SSH": fmt.Sprintf("ssh docker@%s-ELB-SSH.us-east-1.elb.amazonaws.com", name),
+	}
+	if f.Outputs != nil {
+		outputs = f.Outputs(name)
+	}
+
+	s := &fakeStack{
+		stack: &cloudformation.Stack{
+			StackId:      aws.String(id),
+			StackName:    aws.String(name),
+			StackStatus:  aws.String(cloudformation.StackStatusCreateComplete),
+			CreationTime: aws.Time(created),
+		},
+		template: template,
+	}
+	for k, v := range outputs {
+		s.stack.Outputs = append(s.stack.Outputs, &cloudformation.Output{
+			OutputKey:   aws.String(k),
+			OutputValue: aws.String(v),
+		})
+	}
+	f.stacks = append(f.stacks, s)
+	return s
+}
+
+// find looks a stack up. Deleted stacks can only be found by ID, like on AWS.
+func (f *fakeCloudFormation) find(nameOrID string, deleted bool) *fakeStack {
+	for _, s := range f.stacks {
+		if *s.stack.StackId == nameOrID && (deleted || s.deleted == nil) {
+			return s
+		}
+		if *s.stack.StackName == nameOrID && s.deleted == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *fakeCloudFormation) notFound(nameOrID string) error {
+	return awserr.New("ValidationError", fmt.Sprintf("Stack with id %s does not exist", nameOrID), nil)
+}
+
+func (f *fakeCloudFormation) CreateStack(input *cloudformation.CreateStackInput) (*cloudformation.CreateStackOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.StringValue(input.StackName)
+	if f.find(name, false) != nil {
+		return nil, awserr.New(cloudformation.ErrCodeAlreadyExistsException, fmt.Sprintf("Stack [%s] already exists", name), nil)
+	}
+
+	template := aws.StringValue(input.TemplateURL)
+	if template == "" {
+		template = aws.StringValue(input.TemplateBody)
+	}
+	s := f.newStack(name, template, time.Now().UTC())
+	s.stack.Parameters = input.Parameters
+	s.stack.Tags = input.Tags
+	s.addEvent(name, cloudformation.ResourceStatusCreateInProgress, "User Initiated")
+	s.addEvent("ManagerAsg", cloudformation.ResourceStatusCreateInProgress, "")
+	if f.FailCreate[name] {
+		s.stack.StackStatus = aws.String(cloudformation.StackStatusRollbackComplete)
+		s.stack.StackStatusReason = aws.String("The following resource(s) failed to create: [ManagerAsg]")
+		s.addEvent("ManagerAsg", cloudformation.ResourceStatusCreateFailed, "Instance failed to launch")
+	} else {
+		s.addEvent("ManagerAsg", cloudformation.ResourceStatusCreateComplete, "")
+		s.addEvent(name, cloudformation.StackStatusCreateComplete, "")
+	}
+	return &cloudformation.CreateStackOutput{StackId: s.stack.StackId}, nil
+}
+
+func (f *fakeCloudFormation) UpdateStack(input *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.find(aws.StringValue(input.StackName), false)
+	if s == nil {
+		return nil, f.notFound(aws.StringValue(input.StackName))
+	}
+
+	s.stack.LastUpdatedTime = aws.Time(time.Now().UTC())
+	s.addEvent(aws.StringValue(s.stack.StackName), cloudformation.StackStatusUpdateInProgress, "User Initiated")
+	if f.FailUpdate {
+		s.addEvent("ManagerAsg", "UPDATE_FAILED", "Received 0 SUCCESS signal(s) out of 1")
+		s.stack.StackStatus = aws.String(cloudformation.StackStatusUpdateRollbackComplete)
+		s.addEvent(aws.StringValue(s.stack.StackName), cloudformation.StackStatusUpdateRollbackComplete, "")
+	} else {
+		s.template = aws.StringValue(input.TemplateURL)
+		if s.template == "" {
+			s.template = aws.StringValue(input.TemplateBody)
+		}
+		s.stack.Parameters = input.Parameters
+		s.stack.StackStatus = aws.String(cloudformation.StackStatusUpdateComplete)
+		s.addEvent(aws.StringValue(s.stack.StackName), cloudformation.StackStatusUpdateComplete, "")
+	}
+	return &cloudformation.UpdateStackOutput{StackId: s.stack.StackId}, nil
+}
+
+func (s *fakeStack) addEvent(resource, status, reason string) {
+	s.events = append(s.events, &cloudformation.StackEvent{
+		EventId:              aws.String(strconv.Itoa(len(s.events))),
+		StackId:              s.stack.StackId,
+		StackName:            s.stack.StackName,
+		LogicalResourceId:    aws.String(resource),
+		ResourceStatus:       aws.String(status),
+		ResourceStatusReason: aws.String(reason),
+		Timestamp:            aws.Time(time.Now()),
+	})
+}
+
+func (f *fakeCloudFormation) DeleteStack(input *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Deleting a stack that doesn't exist is not an error on AWS.
+	if s := f.find(aws.StringValue(input.StackName), false); s != nil {
+		s.deleted = aws.Time(time.Now().UTC())
+		s.stack.StackStatus = aws.String(cloudformation.StackStatusDeleteComplete)
+	}
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if input.StackName != nil {
+		s := f.find(*input.StackName, true)
+		if s == nil {
+			return nil, f.notFound(*input.StackName)
+		}
+		return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{s.stack}}, nil
+	}
+
+	stacks := []*cloudformation.Stack{}
+	for _, s := range f.stacks {
+		if s.deleted == nil {
+			stacks = append(stacks, s.stack)
+		}
+	}
+	start, end, next := f.page(input.NextToken, len(stacks))
+	return &cloudformation.DescribeStacksOutput{Stacks: stacks[start:end], NextToken: next}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStacksPages(input *cloudformation.DescribeStacksInput, fn func(*cloudformation.DescribeStacksOutput, bool) bool) error {
+	in := *input
+	for {
+		page, err := f.DescribeStacks(&in)
+		if err != nil {
+			return err
+		}
+		if !fn(page, page.NextToken == nil) || page.NextToken == nil {
+			return nil
+		}
+		in.NextToken = page.NextToken
+	}
+}
+
+func (f *fakeCloudFormation) ListStacks(input *cloudformation.ListStacksInput) (*cloudformation.ListStacksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	summaries := []*cloudformation.StackSummary{}
+	for _, s := range f.stacks {
+		summaries = append(summaries, &cloudformation.StackSummary{
+			StackId:      s.stack.StackId,
+			StackName:    s.stack.StackName,
+			StackStatus:  s.stack.StackStatus,
+			CreationTime: s.stack.CreationTime,
+			DeletionTime: s.deleted,
+		})
+	}
+	start, end, next := f.page(input.NextToken, len(summaries))
+	return &cloudformation.ListStacksOutput{StackSummaries: summaries[start:end], NextToken: next}, nil
+}
+
+func (f *fakeCloudFormation) ListStacksPages(input *cloudformation.ListStacksInput, fn func(*cloudformation.ListStacksOutput, bool) bool) error {
+	in := *input
+	for {
+		page, err := f.ListStacks(&in)
+		if err != nil {
+			return err
+		}
+		if !fn(page, page.NextToken == nil) || page.NextToken == nil {
+			return nil
+		}
+		in.NextToken = page.NextToken
+	}
+}
+
+func (f *fakeCloudFormation) DescribeStackEvents(input *cloudformation.DescribeStackEventsInput) (*cloudformation.DescribeStackEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.find(aws.StringValue(input.StackName), true)
+	if s == nil {
+		return nil, f.notFound(aws.StringValue(input.StackName))
+	}
+
+	// Events are returned newest first.
+	events := []*cloudformation.StackEvent{}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		events = append(events, s.events[i])
+	}
+	start, end, next := f.page(input.NextToken, len(events))
+	return &cloudformation.DescribeStackEventsOutput{StackEvents: events[start:end], NextToken: next}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStackEventsPages(input *cloudformation.DescribeStackEventsInput, fn func(*cloudformation.DescribeStackEventsOutput, bool) bool) error {
+	in := *input
+	for {
+		page, err := f.DescribeStackEvents(&in)
+		if err != nil {
+			return err
+		}
+		if !fn(page, page.NextToken == nil) || page.NextToken == nil {
+			return nil
+		}
+		in.NextToken = page.NextToken
+	}
+}
+
+func (f *fakeCloudFormation) WaitUntilStackCreateComplete(input *cloudformation.DescribeStacksInput) error {
+	return f.waitFor(input, cloudformation.StackStatusCreateComplete)
+}
+
+func (f *fakeCloudFormation) WaitUntilStackUpdateComplete(input *cloudformation.DescribeStacksInput) error {
+	return f.waitFor(input, cloudformation.StackStatusUpdateComplete)
+}
+
+func (f *fakeCloudFormation) WaitUntilStackDeleteComplete(input *cloudformation.DescribeStacksInput) error {
+	return f.waitFor(input, cloudformation.StackStatusDeleteComplete)
+}
+
+// waitFor mimics the SDK waiters, which fail if the stack reaches another
+// stable state.
+func (f *fakeCloudFormation) waitFor(input *cloudformation.DescribeStacksInput, status string) error {
+	output, err := f.DescribeStacks(input)
+	if err != nil {
+		return err
+	}
+	if got := aws.StringValue(output.Stacks[0].StackStatus); got != status {
+		return awserr.New("ResourceNotReady", fmt.Sprintf("failed waiting for successful resource state (%s)", got), nil)
+	}
+	return nil
+}
+
+// page returns the bounds of the page starting at token, and the token of the
+// next page.
+func (f *fakeCloudFormation) page(token *string, total int) (int, int, *string) {
+	start := 0
+	if token != nil {
+		start, _ = strconv.Atoi(*token)
+	}
+	end := start + f.PageSize
+	if f.PageSize <= 0 || end >= total {
+		return start, total, nil
+	}
+	return start, end, aws.String(strconv.Itoa(end))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Command is a shell command run on the environment. In the config it can be
+// written either as a plain string or as a mapping:
+//
+//	commands:
+//	  - docker version
+//	  - run: docker run -e DOCKER_E2E_ENDPOINT dockerswarm/e2e
+//	    env:
+//	      DOCKER_E2E_ENDPOINT: 10.0.0.1
+type Command struct {
+	Run string `yaml:"run"`
+
+	// Env is the environment of the command, on top of the config-wide one.
+	Env map[string]EnvValue `yaml:"env,omitempty"`
+
+	// Retry re-runs the go tests failing in the command.
+	Retry *Retry `yaml:"retry,omitempty"`
+
+	// Chaos is a built-in action degrading the cluster, run instead of a
+	// shell command.
+	Chaos *Chaos `yaml:"chaos,omitempty"`
+}
+
+// UnmarshalYAML accepts both the short (string) and long (mapping) forms.
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var run string
+	if err := unmarshal(&run); err == nil {
+		*c = Command{Run: run}
+		return nil
+	}
+
+	type command Command
+	var long command
+	if err := unmarshal(&long); err != nil {
+		return err
+	}
+	*c = Command(long)
+	return nil
+}
+
+// EnvValue is the value of a remote environment variable. It is either given
+// inline or read from the local environment or a local file at run time, so
+// secrets don't need to be written in the config.
+type EnvValue struct {
+	Value    string `yaml:"value,omitempty"`
+	FromEnv  string `yaml:"from_env,omitempty"`
+	FromFile string `yaml:"from_file,omitempty"`
+
+	// Secret values are masked when logged. Values read from the local
+	// environment or a file are secret unless it is set to false.
+	Secret *bool `yaml:"secret,omitempty"`
+}
+
+// UnmarshalYAML accepts a plain string as an inline value.
+func (v *EnvValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*v = EnvValue{Value: value}
+		return nil
+	}
+
+	type envValue EnvValue
+	var long envValue
+	if err := unmarshal(&long); err != nil {
+		return err
+	}
+	*v = EnvValue(long)
+	return nil
+}
+
+// IsSecret returns whether the value must not be logged.
+func (v EnvValue) IsSecret() bool {
+	if v.Secret != nil {
+		return *v.Secret
+	}
+	return v.FromEnv != "" || v.FromFile != ""
+}
+
+// Resolve returns the actual value of the variable.
+func (v EnvValue) Resolve() (string, error) {
+	switch {
+	case v.FromEnv != "":
+		value, ok := os.LookupEnv(v.FromEnv)
+		if !ok {
+			return "", errors.Errorf("local environment variable %s is not set", v.FromEnv)
+		}
+		return value, nil
+	case v.FromFile != "":
+		data, err := ioutil.ReadFile(v.FromFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return v.Value, nil
+}
+
+// Env is a resolved environment, ready to be applied to a remote command.
+type Env struct {
+	values  map[string]string
+	secrets map[string]bool
+}
+
+// resolveEnv merges environments, later ones taking precedence, and resolves
+// all values.
+func resolveEnv(envs ...map[string]EnvValue) (*Env, error) {
+	env := &Env{
+		values:  make(map[string]string),
+		secrets: make(map[string]bool),
+	}
+	for _, e := range envs {
+		for name, v := range e {
+			value, err := v.Resolve()
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to resolve %s", name)
+			}
+			env.values[name] = value
+			env.secrets[name] = v.IsSecret()
+		}
+	}
+	return env, nil
+}
+
+// with returns a copy of the environment with an additional variable.
+func (e *Env) with(name, value string) *Env {
+	env := &Env{
+		values:  map[string]string{name: value},
+		secrets: map[string]bool{},
+	}
+	for k, v := range e.values {
+		if k != name {
+			env.values[k] = v
+			env.secrets[k] = e.secrets[k]
+		}
+	}
+	return env
+}
+
+// Names returns the sorted variable names.
+func (e *Env) Names() []string {
+	names := make([]string, 0, len(e.values))
+	for name := range e.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Values returns the resolved variables.
+func (e *Env) Values() map[string]string {
+	return e.values
+}
+
+// String formats the environment as a command prefix, with secrets masked.
+func (e *Env) String() string {
+	vars := []string{}
+	for _, name := range e.Names() {
+		value := e.values[name]
+		if e.secrets[name] {
+			value = "***"
+		}
+		vars = append(vars, fmt.Sprintf("%s=%s", name, value))
+	}
+	return strings.Join(vars, " ")
+}
+
+// exportPrefix returns a shell snippet exporting env, to be prepended to a
+// command when the SSH server refuses setenv requests.
+func exportPrefix(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefix := ""
+	for _, name := range names {
+		prefix += fmt.Sprintf("export %s=%s; ", name, shellQuote(env[name]))
+	}
+	return prefix
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEnvValueIsSecret(t *testing.T) {
+	var env map[string]EnvValue
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+INLINE: value
+TOKEN: {from_env: GITHUB_TOKEN}
+KEY: {from_file: /etc/key}
+USER: {from_env: USER, secret: false}
+PASSWORD: {value: s3cr3t, secret: true}
+`), &env))
+	assert.False(t, env["INLINE"].IsSecret())
+	assert.True(t, env["TOKEN"].IsSecret(), "values from the environment must be secret by default")
+	assert.True(t, env["KEY"].IsSecret())
+	assert.False(t, env["USER"].IsSecret())
+	assert.True(t, env["PASSWORD"].IsSecret())
+}
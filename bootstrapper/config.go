@@ -0,0 +1,439 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type Config struct {
+	Environment *EnvironmentConfig `yaml:"environment,omitempty"`
+
+	// Env is the remote environment of all commands.
+	Env map[string]EnvValue `yaml:"env,omitempty"`
+
+	Commands []Command `yaml:"commands,omitempty"`
+
+	// Matrix runs the commands on several variants of the environment.
+	Matrix *Matrix `yaml:"matrix,omitempty"`
+
+	// Upgrade is the scenario of the upgrade command.
+	Upgrade *Upgrade `yaml:"upgrade,omitempty"`
+
+	// Pool keeps environments provisioned ahead of runs.
+	Pool *PoolConfig `yaml:"pool,omitempty"`
+
+	// Budget limits the stacks and instance-hours runs may use.
+	Budget *Budget `yaml:"budget,omitempty"`
+
+	// Quarantine is the path of the list of tests whose failures are
+	// ignored, relative to the config, see QuarantineEntry.
+	Quarantine string `yaml:"quarantine,omitempty"`
+
+	// Metrics exports the timings of runs.
+	Metrics *MetricsConfig `yaml:"metrics,omitempty"`
+
+	// Notify lists where the summary of runs is posted.
+	Notify *NotifyConfig `yaml:"notify,omitempty"`
+
+	// Artifacts is a local directory where the output of every command is
+	// saved.
+	Artifacts string `yaml:"artifacts,omitempty"`
+	// Quiet disables streaming command output to the console.
+	Quiet bool `yaml:"quiet,omitempty"`
+
+	// output receives the output of the commands, in addition to the
+	// console and the artifacts.
+	output io.Writer
+	// localTests is the path of the tests built by --local-tests, uploaded
+	// to the manager before the commands.
+	localTests string
+}
+
+// logger returns the logger of the runs of the config, see
+// EnvironmentConfig.log.
+func (c *Config) logger() *logrus.Entry {
+	return c.Environment.logger()
+}
+
+// Keys processed by the loader rather than being part of Config.
+const (
+	extendsKey  = "extends"
+	includeKey  = "include"
+	overlaysKey = "overlays"
+)
+
+// ConfigOptions controls how a config file is loaded.
+type ConfigOptions struct {
+	// Vars are substituted for ${NAME} in config files. They take precedence
+	// over the local environment.
+	Vars map[string]string
+	// Overlays are the names of the entries of the "overlays" section to
+	// merge, in order, on top of the config.
+	Overlays []string
+}
+
+// loadConfig reads the config at path. Loading happens in the following
+// order:
+//
+//   - ${NAME} and ${NAME:-default} are substituted from the variables and
+//     the local environment in the values of the config, once parsed. "$$"
+//     is a literal "$". The commands are run by the remote shell and left
+//     alone, variables reach them through "env".
+//   - Local templates and quarantine files are made relative to the file
+//     declaring them.
+//   - The configs listed in "extends" (a base config) and "include"
+//     (shared fragments) are loaded the same way, relative to path, and the
+//     config is merged on top of them.
+//   - The selected "overlays" are merged on top of the result.
+//
+// Mappings are merged recursively, anything else (including lists) is
+// replaced. Each file is checked against the config schema, and the merged
+// config is validated.
+func loadConfig(path string, opts *ConfigOptions) (*Config, error) {
+	if opts == nil {
+		opts = &ConfigOptions{}
+	}
+
+	tree, err := loadConfigTree(path, opts.Vars, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	overlays, err := popOverlays(tree)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range opts.Overlays {
+		overlay, ok := overlays[name]
+		if !ok {
+			return nil, errors.Errorf("overlay %q not found in %s", name, path)
+		}
+		tree = mergeTrees(tree, overlay).(map[interface{}]interface{})
+	}
+
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	if err := config.Validate(); err != nil {
+		if configErr, ok := err.(*ConfigError); ok {
+			configErr.File = path
+		}
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadConfigTree reads a config file as a generic YAML tree, with variables
+// substituted and the extended configs merged. parents are the files being
+// loaded, to detect cycles.
+func loadConfigTree(path string, vars map[string]string, parents []string) (map[interface{}]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parents {
+		if p == abs {
+			return nil, errors.Errorf("config %s extends itself", path)
+		}
+	}
+	parents = append(parents, abs)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	expanded, err := expandVars(raw, vars)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	tree := expanded.(map[interface{}]interface{})
+
+	// The schema is checked on the file itself when possible, so that
+	// problems have the right line numbers.
+	if !reflect.DeepEqual(raw, tree) {
+		if data, err = yaml.Marshal(tree); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSchema(path, data); err != nil {
+		return nil, err
+	}
+	resolveTemplates(tree, filepath.Dir(path))
+
+	bases := []string{}
+	for _, key := range []string{extendsKey, includeKey} {
+		paths, err := stringList(tree[key])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: %s", path, key)
+		}
+		bases = append(bases, paths...)
+		delete(tree, key)
+	}
+
+	merged := make(map[interface{}]interface{})
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(path), base)
+		}
+		baseTree, err := loadConfigTree(base, vars, parents)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeTrees(merged, baseTree).(map[interface{}]interface{})
+	}
+	return mergeTrees(merged, tree).(map[interface{}]interface{}), nil
+}
+
+// resolveTemplates makes the local templates and the quarantine file of a
+// config file, including the ones of its overlays, relative to the file
+// rather than to the current directory.
+func resolveTemplates(tree map[interface{}]interface{}, dir string) {
+	if quarantine, ok := tree["quarantine"].(string); ok && quarantine != "" && !filepath.IsAbs(quarantine) {
+		tree["quarantine"] = filepath.Join(dir, quarantine)
+	}
+	for _, section := range []string{"environment", "upgrade"} {
+		if m, ok := tree[section].(map[interface{}]interface{}); ok {
+			if template, ok := m["template"].(string); ok {
+				m["template"] = resolveTemplate(dir, template)
+			}
+		}
+	}
+	if m, ok := tree["matrix"].(map[interface{}]interface{}); ok {
+		if templates, ok := m["templates"].([]interface{}); ok {
+			for i, t := range templates {
+				if template, ok := t.(string); ok {
+					templates[i] = resolveTemplate(dir, template)
+				}
+			}
+		}
+	}
+	if overlays, ok := tree[overlaysKey].(map[interface{}]interface{}); ok {
+		for _, overlay := range overlays {
+			if m, ok := overlay.(map[interface{}]interface{}); ok {
+				resolveTemplates(m, dir)
+			}
+		}
+	}
+}
+
+func resolveTemplate(dir, template string) string {
+	if template == "" || isTemplateURL(template) || filepath.IsAbs(template) {
+		return template
+	}
+	return filepath.Join(dir, template)
+}
+
+// popOverlays removes the overlays section from tree and returns it.
+func popOverlays(tree map[interface{}]interface{}) (map[string]interface{}, error) {
+	section, ok := tree[overlaysKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(tree, overlaysKey)
+
+	entries, ok := section.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("overlays must be a mapping")
+	}
+	overlays := make(map[string]interface{})
+	for name, overlay := range entries {
+		if _, ok := overlay.(map[interface{}]interface{}); !ok {
+			return nil, errors.Errorf("overlay %v must be a mapping", name)
+		}
+		overlays[toString(name)] = overlay
+	}
+	return overlays, nil
+}
+
+// mergeTrees merges overlay on top of base. Mappings are merged recursively,
+// other values from overlay replace the ones in base.
+func mergeTrees(base, overlay interface{}) interface{} {
+	baseMap, ok := base.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+	overlayMap, ok := overlay.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+
+	merged := make(map[interface{}]interface{}, len(baseMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overlayMap {
+		merged[k] = mergeTrees(baseMap[k], v)
+	}
+	return merged
+}
+
+// stringList accepts either a single string or a list of strings.
+func stringList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.Errorf("expected a string, got %v", item)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, errors.Errorf("expected a string or a list of strings, got %v", v)
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := yaml.Marshal(v)
+	return strings.TrimSpace(string(data))
+}
+
+var varPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// shellKeys are the keys holding commands, or lists of commands, run by the
+// remote shell. Their strings are left alone: "${HOME}" there is shell
+// syntax.
+var shellKeys = map[interface{}]bool{"commands": true, "before": true, "after": true, "run": true}
+
+// expandVars substitutes variables in the string scalars of a parsed config,
+// so that values can't change its structure. A scalar which is only a number
+// or a boolean once expanded, such as "${MANAGERS}", gets that type. It fails
+// if a variable without default is not defined.
+func expandVars(tree interface{}, vars map[string]string) (interface{}, error) {
+	missing := map[string]bool{}
+	expanded := expandNode(tree, false, vars, missing)
+
+	if len(missing) > 0 {
+		names := []string{}
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("undefined variables: %s (set them with --set NAME=VALUE, or write $$ for a literal $)", strings.Join(names, ", "))
+	}
+	return expanded, nil
+}
+
+// expandNode expands the variables of node. shell is set for the commands,
+// whose strings are kept as is.
+func expandNode(node interface{}, shell bool, vars map[string]string, missing map[string]bool) interface{} {
+	switch n := node.(type) {
+	case string:
+		if shell {
+			return n
+		}
+		return expandScalar(n, vars, missing)
+	case []interface{}:
+		list := make([]interface{}, len(n))
+		for i, item := range n {
+			list[i] = expandNode(item, shell, vars, missing)
+		}
+		return list
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(n))
+		for k, v := range n {
+			m[k] = expandNode(v, shellKeys[k], vars, missing)
+		}
+		return m
+	}
+	return node
+}
+
+func expandScalar(s string, vars map[string]string, missing map[string]bool) interface{} {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	expanded := varPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		m := varPattern.FindStringSubmatch(match)
+		name, hasDefault, def := m[1], m[2] != "", m[3]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if hasDefault {
+			return def
+		}
+		missing[name] = true
+		return match
+	})
+
+	// Only values written back identically are typed, "0123" or "yes" stay
+	// strings.
+	if i, err := strconv.Atoi(expanded); err == nil && strconv.Itoa(i) == expanded {
+		return i
+	}
+	if f, err := strconv.ParseFloat(expanded, 64); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == expanded {
+		return f
+	}
+	if expanded == "true" || expanded == "false" {
+		return expanded == "true"
+	}
+	return expanded
+}
+
+// addConfigFlags registers the flags controlling how configs are loaded.
+func addConfigFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("set", nil, "Set a config variable (NAME=VALUE)")
+	cmd.Flags().StringSlice("overlay", nil, "Apply an overlay of the config")
+}
+
+// configOptions returns the config loading options set on the command line.
+func configOptions(cmd *cobra.Command) (*ConfigOptions, error) {
+	sets, err := cmd.Flags().GetStringArray("set")
+	if err != nil {
+		return nil, err
+	}
+	overlays, err := cmd.Flags().GetStringSlice("overlay")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &ConfigOptions{
+		Vars:     make(map[string]string),
+		Overlays: overlays,
+	}
+	for _, set := range sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid --set %q, expected NAME=VALUE", set)
+		}
+		opts.Vars[parts[0]] = parts[1]
+	}
+	return opts, nil
+}
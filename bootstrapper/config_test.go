@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const varsConfig = `environment:
+  template: ${TEMPLATE}
+  managers: ${MANAGERS}
+  workers: ${WORKERS:-2}
+  ssh_keyname: swarm
+  instance_type: t2.micro
+  tags: {build: "${BUILD}"}
+env:
+  SUITE: ${SUITE}
+  PRICE: $$5
+commands:
+  # ${UNDEFINED} in a comment is ignored
+  - echo "${SUITE}" $$
+  - run: echo ${HOME}
+    env: {BUILD: "${BUILD}"}
+    retry:
+      attempts: 2
+      run: echo ${UNDEFINED}
+`
+
+func writeTestConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "e2e.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigVars(t *testing.T) {
+	path, cleanup := writeTestConfig(t, varsConfig)
+	defer cleanup()
+
+	suite := "smoke: all # of them\nenv: {X: {from_file: /etc/passwd}}"
+	config, err := loadConfig(path, &ConfigOptions{Vars: map[string]string{
+		"TEMPLATE": "https://example.com/nightly.json",
+		"MANAGERS": "3",
+		"BUILD":    "0123",
+		"SUITE":    suite,
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://example.com/nightly.json", config.Environment.Template)
+	assert.Equal(t, 3, config.Environment.Managers)
+	assert.Equal(t, 2, config.Environment.Workers)
+	assert.Equal(t, map[string]string{"build": "0123"}, config.Environment.Tags)
+	assert.Equal(t, map[string]EnvValue{"SUITE": {Value: suite}, "PRICE": {Value: "$5"}}, config.Env)
+	assert.Equal(t, []Command{
+		{Run: `echo "${SUITE}" $$`},
+		{Run: "echo ${HOME}", Env: map[string]EnvValue{"BUILD": {Value: "0123"}}, Retry: &Retry{Attempts: 2, Run: "echo ${UNDEFINED}"}},
+	}, config.Commands, "commands are shell syntax")
+}
+
+func TestLoadConfigUndefinedVars(t *testing.T) {
+	path, cleanup := writeTestConfig(t, varsConfig)
+	defer cleanup()
+
+	_, err := loadConfig(path, &ConfigOptions{Vars: map[string]string{"SUITE": "smoke"}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "undefined variables: BUILD, MANAGERS, TEMPLATE (set them with --set NAME=VALUE, or write $$ for a literal $)")
+	}
+}
+
+func TestLoadConfigLocalTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "configs"), 0755))
+	template := filepath.Join(dir, "configs", "template.json")
+	assert.NoError(t, ioutil.WriteFile(template, []byte("{}"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "configs", "quarantine.yml"), []byte("[]"), 0644))
+
+	path := filepath.Join(dir, "configs", "e2e.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`environment:
+  template: template.json
+  ssh_keyname: swarm
+  instance_type: t2.micro
+  managers: 1
+commands: [docker version]
+quarantine: quarantine.yml
+overlays:
+  upgrade:
+    upgrade:
+      template: template.json
+      after: [docker version]
+`), 0644))
+
+	config, err := loadConfig(path, &ConfigOptions{Overlays: []string{"upgrade"}})
+	if assert.NoError(t, err, "templates and quarantine must be relative to the config") {
+		assert.Equal(t, template, config.Environment.Template)
+		assert.Equal(t, template, config.Upgrade.Template)
+		assert.Equal(t, filepath.Join(dir, "configs", "quarantine.yml"), config.Quarantine)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2017, 3, 15, 10, 30, 45, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"0 2 * * *", time.Date(2017, 3, 16, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2017, 3, 16, 10, 30, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2017, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2017, 3, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 3, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan,jul *", time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are set.
+		{"0 0 20 * 5", time.Date(2017, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", now.Add(90 * time.Minute)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		c, err := parseCron(tc.spec)
+		if assert.NoError(t, err, tc.spec) {
+			assert.Equal(t, tc.next, c.Next(now), tc.spec)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"-1 * * * *",
+		"* * * * sunday",
+		"@sometimes",
+		"@every 10s",
+		"@every soon",
+	} {
+		_, err := parseCron(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/user"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,22 +14,30 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 	"github.com/pkg/errors"
 )
 
-// Purge deletes stacks older than `ttl`
-func Purge(sess *session.Session, ttl time.Duration) {
-	cf := cloudformation.New(sess)
-
-	resp, err := cf.ListStacks(&cloudformation.ListStacksInput{})
+// Purge deletes stacks older than `ttl`, except the ones in `keep`
+func Purge(cf cloudformationiface.CloudFormationAPI, prefix string, ttl time.Duration, keep map[string]bool) error {
+	summaries := []*cloudformation.StackSummary{}
+	err := cf.ListStacksPages(&cloudformation.ListStacksInput{}, func(page *cloudformation.ListStacksOutput, lastPage bool) bool {
+		summaries = append(summaries, page.StackSummaries...)
+		return true
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	for _, ss := range resp.StackSummaries {
+
+	for _, ss := range summaries {
 		// Skip stacks that don't belong to us.
-		if !strings.HasPrefix(*ss.StackName, "docker-e2e-") {
+		if !strings.HasPrefix(*ss.StackName, prefix+"-") {
+			continue
+		}
+
+		// Stacks in use by pools are long lived.
+		if keep[*ss.StackId] {
 			continue
 		}
 
@@ -53,19 +62,45 @@ func Purge(sess *session.Session, ttl time.Duration) {
 			logrus.Errorf("Failed to delete %s: %v", *ss.StackName, err)
 		}
 	}
+	return nil
 }
 
 type Environment struct {
 	id     string
-	cf     *cloudformation.CloudFormation
+	cf     cloudformationiface.CloudFormationAPI
 	client *ssh.Client
+
+	// jumpHosts are traversed in order to reach the manager. clients holds
+	// the connection to each of them, followed by client.
+	jumpHosts []JumpHost
+	clients   []*ssh.Client
+
+	// keyFile is the private key of the environment, see
+	// EnvironmentConfig.SSHKeyFile.
+	keyFile string
+	// knownHosts holds the keys of the jump hosts, see
+	// EnvironmentConfig.KnownHosts.
+	knownHosts string
+
+	// log is the logger of the run, see EnvironmentConfig.log.
+	log *logrus.Entry
+
+	// connectDuration is how long the last Connect took.
+	connectDuration time.Duration
 }
 
-func NewEnvironment(id string, sess *session.Session) *Environment {
-	return &Environment{
-		id: id,
-		cf: cloudformation.New(sess),
+func NewEnvironment(id string, cf cloudformationiface.CloudFormationAPI, config *EnvironmentConfig) *Environment {
+	env := &Environment{
+		id:  id,
+		cf:  cf,
+		log: config.logger(),
+	}
+	if config != nil {
+		env.jumpHosts = config.JumpHosts
+		env.keyFile = config.SSHKeyFile
+		env.knownHosts = config.KnownHosts
 	}
+	return env
 }
 
 func (c *Environment) Destroy() error {
@@ -75,133 +110,277 @@ func (c *Environment) Destroy() error {
 	return err
 }
 
-func (c *Environment) sshEndpoint() (string, error) {
+// Outputs returns the outputs of the stack of the environment.
+func (c *Environment) Outputs() (*Outputs, error) {
 	output, err := c.cf.DescribeStacks(&cloudformation.DescribeStacksInput{
 		StackName: aws.String(c.id),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(output.Stacks) != 1 {
-		return "", errors.New("stack not found")
+		return nil, errors.New("stack not found")
 	}
+	return newOutputs(output.Stacks[0]), nil
+}
 
-	for _, o := range output.Stacks[0].Outputs {
-		if *o.OutputKey == "SSH" {
-			// Formatted as "ssh docker@docker-e2e-20160928-ELB-SSH-1653593963.us-east-1.elb.amazonaws.com"
-			endpoint := *o.OutputValue
-			return strings.SplitN(endpoint, "@", 2)[1] + ":22", nil
-		}
+func (c *Environment) sshEndpoint() (string, error) {
+	outputs, err := c.Outputs()
+	if err != nil {
+		return "", err
 	}
+	return outputs.SSHEndpoint()
+}
 
-	return "", errors.New("unable to retrieve SSH endpoint")
+// parseSSHOutput returns the address of the SSH output of a stack, formatted
+// as "ssh docker@docker-e2e-20160928-ELB-SSH-1653593963.us-east-1.elb.amazonaws.com".
+func parseSSHOutput(output string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(output), "@", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", errors.Errorf("malformed SSH output %q", output)
+	}
+	return withDefaultPort(strings.TrimSpace(parts[1])), nil
 }
 
+// Connect opens an SSH connection to the manager of the environment, going
+// through the configured jump hosts if any.
 func (c *Environment) Connect() error {
+	start := time.Now()
 	endpoint, err := c.sshEndpoint()
 	if err != nil {
 		return err
 	}
 
-	usr, err := user.Current()
+	hops := []sshHop{}
+	for _, j := range c.jumpHosts {
+		hop, err := j.hop(c.keyFile, c.knownHosts)
+		if err != nil {
+			return err
+		}
+		hops = append(hops, hop)
+	}
+
+	config, err := sshClientConfig("", c.keyFile)
 	if err != nil {
 		return err
 	}
+	hops = append(hops, sshHop{address: endpoint, config: config})
 
-	key, err := ioutil.ReadFile(filepath.Join(usr.HomeDir, "/.ssh/swarm.pem"))
+	clients, err := dialChain(hops)
 	if err != nil {
-		return errors.Wrap(err, "unable to read private key")
+		return err
 	}
+	c.clients = clients
+	c.client = clients[len(clients)-1]
+	c.connectDuration = time.Since(start)
+	return nil
+}
 
-	signer, err := ssh.ParsePrivateKey(key)
+// DialNode opens an SSH connection to another node of the environment (such
+// as a worker, given its private address), using the manager as jump host.
+// The environment must be connected.
+func (c *Environment) DialNode(address string) (*ssh.Client, error) {
+	if c.client == nil {
+		return nil, errors.New("environment is not connected")
+	}
+	config, err := sshClientConfig("", c.keyFile)
 	if err != nil {
-		return errors.Wrap(err, "unable to parse private key")
+		return nil, err
 	}
+	return dialThrough(c.client, withDefaultPort(address), config)
+}
 
-	conn, err := ssh.Dial("tcp", endpoint,
-		&ssh.ClientConfig{
-			User: "docker",
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			},
-		},
-	)
+// ConnectNode makes the commands run on another manager, given its private
+// address. The connection goes through the current manager, whose sshd
+// outlives its docker, so that docker can be killed there.
+func (c *Environment) ConnectNode(address string) error {
+	client, err := c.DialNode(address)
 	if err != nil {
 		return err
 	}
-	c.client = conn
+	c.clients = append(c.clients, client)
+	c.client = client
 	return nil
 }
 
 func (c *Environment) Disconnect() error {
-	return c.client.Close()
+	err := closeClients(c.clients)
+	c.clients = nil
+	c.client = nil
+	return err
 }
 
-func (c *Environment) Run(cmd string) error {
+// Result is the outcome of a command run on an environment.
+type Result struct {
+	Command string
+
+	Stdout []byte
+	Stderr []byte
+
+	// ExitStatus is the remote exit code, or -1 if the command did not exit
+	// normally (killed by a signal or the connection was lost).
+	ExitStatus int
+	// Signal is set if the command was terminated by a signal.
+	Signal string
+
+	Duration time.Duration
+
+	// Retries are the runs of the tests which failed in the command, see
+	// Retry. Test is the test a retry ran.
+	Retries []*Result
+	Test    string
+	// Quarantined are the failed tests which were ignored, see Quarantine.
+	Quarantined []string
+	// Logs is the path of the output files of the command in the artifacts,
+	// without their .stdout.log and .stderr.log suffixes, if they are saved.
+	Logs string
+}
+
+// Run executes cmd in a new SSH session and waits for it to complete. Output
+// is captured in the returned Result and additionally copied to the provided
+// stdout and stderr writers (if not nil) as it arrives. A Result is returned
+// even if the command fails.
+//
+// env is set on the session if the SSH server accepts it, and exported by the
+// remote shell before running cmd otherwise. Either way, values are not part
+// of Result.Command.
+func (c *Environment) Run(cmd string, env map[string]string, stdout, stderr io.Writer) (*Result, error) {
+	result := &Result{
+		Command:    cmd,
+		ExitStatus: -1,
+	}
+
 	session, err := c.client.NewSession()
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer session.Close()
 
-	stdout, err := session.StdoutPipe()
-	if err != nil {
-		return err
+	remoteCmd := cmd
+	for name, value := range env {
+		if err := session.Setenv(name, value); err != nil {
+			// Most sshd configurations only accept a few variables (AcceptEnv),
+			// fall back to exporting them from the shell.
+			remoteCmd = exportPrefix(env) + cmd
+			break
+		}
+	}
+
+	var outBuf, errBuf bytes.Buffer
+	session.Stdout = teeWriter(&outBuf, stdout)
+	session.Stderr = teeWriter(&errBuf, stderr)
+
+	// session.Run only returns once both output streams have been fully
+	// copied, so the buffers are complete afterwards.
+	now := time.Now()
+	err = session.Run(remoteCmd)
+	result.Duration = time.Since(now)
+	result.Stdout = outBuf.Bytes()
+	result.Stderr = errBuf.Bytes()
+
+	switch e := err.(type) {
+	case nil:
+		result.ExitStatus = 0
+	case *ssh.ExitError:
+		result.ExitStatus = e.ExitStatus()
+		result.Signal = e.Signal()
 	}
-	stderr, err := session.StderrPipe()
+	return result, err
+}
+
+// Upload copies the content of r to path on the manager, with the given mode.
+func (c *Environment) Upload(r io.Reader, path string, mode os.FileMode) error {
+	session, err := c.client.NewSession()
 	if err != nil {
 		return err
 	}
+	defer session.Close()
 
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
+	var stderr bytes.Buffer
+	session.Stdin = r
+	session.Stderr = &stderr
+	quoted := shellQuote(path)
+	if err := session.Run(fmt.Sprintf("cat > %s && chmod %o %s", quoted, mode.Perm(), quoted)); err != nil {
+		return errors.Wrapf(err, "unable to upload %s: %s", path, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
 
-	return session.Run(cmd)
+func teeWriter(buf io.Writer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
 }
 
+// stackPollInterval is how often stacks are polled while waiting on them.
+var stackPollInterval = 10 * time.Second
+
 type EnvironmentConfig struct {
+	// Template is the URL of the CloudFormation template, or the path of a
+	// local template file.
 	Template string `yaml:"template,omitempty"`
 
 	SSHKeyName string `yaml:"ssh_keyname,omitempty"`
+	// SSHKeyFile is the local private key of the SSHKeyName key pair.
+	// Defaults to ~/.ssh/swarm.pem.
+	SSHKeyFile string `yaml:"ssh_key_file,omitempty"`
 
-	Managers string `yaml:"managers,omitempty"`
-	Workers  string `yaml:"workers,omitempty"`
+	Managers int `yaml:"managers,omitempty"`
+	Workers  int `yaml:"workers,omitempty"`
 
 	InstanceType string `yaml:"instance_type,omitempty"`
+
+	// JumpHosts are SSH proxies traversed, in order, to reach the manager.
+	JumpHosts []JumpHost `yaml:"jump_hosts,omitempty"`
+	// KnownHosts is the known_hosts file of the jump hosts which don't have
+	// their own. The keys of the nodes are never checked: they are created
+	// with the stack.
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+
+	// Tags are added to the stack, along with docker=e2e.
+	Tags map[string]string `yaml:"tags,omitempty"`
+
+	// Naming configures the names of the stacks.
+	Naming *Naming `yaml:"naming,omitempty"`
+
+	// log is the logger of the run using the environment, with its fields,
+	// such as the run ID of a job of serve.
+	log *logrus.Entry
 }
 
-func Provision(sess *session.Session, name string, config *EnvironmentConfig) (*Environment, error) {
-	cf := cloudformation.New(sess)
+// logger returns the logger of the runs of the config, the standard one if
+// none is set.
+func (c *EnvironmentConfig) logger() *logrus.Entry {
+	if c == nil || c.log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return c.log
+}
+
+func Provision(cf cloudformationiface.CloudFormationAPI, name string, config *EnvironmentConfig) (*Environment, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	templateURL, templateBody, err := templateSource(config.Template)
+	if err != nil {
+		return nil, err
+	}
 
 	stack := cloudformation.CreateStackInput{
-		StackName:   aws.String(name),
-		Tags:        []*cloudformation.Tag{{Key: aws.String("docker"), Value: aws.String("e2e")}},
-		TemplateURL: aws.String(config.Template),
+		StackName:    aws.String(name),
+		Tags:         []*cloudformation.Tag{{Key: aws.String("docker"), Value: aws.String("e2e")}},
+		TemplateURL:  templateURL,
+		TemplateBody: templateBody,
 		Capabilities: []*string{
 			aws.String("CAPABILITY_IAM"),
 		},
-		Parameters: []*cloudformation.Parameter{
-			{
-				ParameterKey:   aws.String("KeyName"),
-				ParameterValue: aws.String(config.SSHKeyName),
-			},
-			{
-				ParameterKey:   aws.String("ClusterSize"),
-				ParameterValue: aws.String(config.Workers),
-			},
-			{
-				ParameterKey:   aws.String("ManagerSize"),
-				ParameterValue: aws.String(config.Managers),
-			},
-			{
-				ParameterKey:   aws.String("InstanceType"),
-				ParameterValue: aws.String(config.InstanceType),
-			},
-			{
-				ParameterKey:   aws.String("ManagerInstanceType"),
-				ParameterValue: aws.String(config.InstanceType),
-			},
-		},
+		Parameters: stackParameters(config),
+	}
+
+	for k, v := range config.Tags {
+		stack.Tags = append(stack.Tags, &cloudformation.Tag{Key: aws.String(k), Value: aws.String(v)})
 	}
 
 	output, err := cf.CreateStack(&stack)
@@ -209,12 +388,181 @@ func Provision(sess *session.Session, name string, config *EnvironmentConfig) (*
 		return nil, err
 	}
 
-	logrus.Infof("Stack %s created (%s), waiting to come up...", name, *output.StackId)
+	config.logger().Infof("Stack %s created (%s), waiting to come up...", name, *output.StackId)
 	if err := cf.WaitUntilStackCreateComplete(&cloudformation.DescribeStacksInput{
 		StackName: output.StackId,
 	}); err != nil {
 		return nil, err
 	}
 
-	return NewEnvironment(*output.StackId, sess), nil
+	return NewEnvironment(*output.StackId, cf, config), nil
+}
+
+// stackParameters returns the template parameters for config.
+func stackParameters(config *EnvironmentConfig) []*cloudformation.Parameter {
+	return []*cloudformation.Parameter{
+		{
+			ParameterKey:   aws.String("KeyName"),
+			ParameterValue: aws.String(config.SSHKeyName),
+		},
+		{
+			ParameterKey:   aws.String("ClusterSize"),
+			ParameterValue: aws.String(strconv.Itoa(config.Workers)),
+		},
+		{
+			ParameterKey:   aws.String("ManagerSize"),
+			ParameterValue: aws.String(strconv.Itoa(config.Managers)),
+		},
+		{
+			ParameterKey:   aws.String("InstanceType"),
+			ParameterValue: aws.String(config.InstanceType),
+		},
+		{
+			ParameterKey:   aws.String("ManagerInstanceType"),
+			ParameterValue: aws.String(config.InstanceType),
+		},
+	}
+}
+
+// templateSource returns either the URL or the body of a template, depending
+// on whether it is remote or a local file.
+func templateSource(template string) (url, body *string, err error) {
+	if isTemplateURL(template) {
+		return aws.String(template), nil, nil
+	}
+	data, err := ioutil.ReadFile(template)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, aws.String(string(data)), nil
+}
+
+// Update replaces the template of the environment (keeping its parameters)
+// and waits for the update to complete, logging stack events as they come.
+func (c *Environment) Update(config *EnvironmentConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	templateURL, templateBody, err := templateSource(config.Template)
+	if err != nil {
+		return err
+	}
+
+	// Only the events of this update are logged, the ones of the previous
+	// updates are already there.
+	seen, err := c.eventIDs()
+	if err != nil {
+		return err
+	}
+	_, err = c.cf.UpdateStack(&cloudformation.UpdateStackInput{
+		StackName:    aws.String(c.id),
+		TemplateURL:  templateURL,
+		TemplateBody: templateBody,
+		Capabilities: []*string{
+			aws.String("CAPABILITY_IAM"),
+		},
+		Parameters: stackParameters(config),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.log.Infof("Stack %s updating to %s...", c.id, config.Template)
+	return c.waitForStatus(cloudformation.StackStatusUpdateComplete, seen)
+}
+
+// eventIDs returns the IDs of the current events of the stack.
+func (c *Environment) eventIDs() (map[string]bool, error) {
+	ids := make(map[string]bool)
+	err := c.cf.DescribeStackEventsPages(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(c.id),
+	}, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+		for _, e := range page.StackEvents {
+			ids[aws.StringValue(e.EventId)] = true
+		}
+		return true
+	})
+	return ids, err
+}
+
+// Events returns the events of the stack, oldest first.
+func (c *Environment) Events() ([]StackEvent, error) {
+	events := []StackEvent{}
+	err := c.cf.DescribeStackEventsPages(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(c.id),
+	}, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+		for _, e := range page.StackEvents {
+			events = append(events, StackEvent{
+				Time:     aws.TimeValue(e.Timestamp),
+				Resource: aws.StringValue(e.LogicalResourceId),
+				Type:     aws.StringValue(e.ResourceType),
+				Status:   aws.StringValue(e.ResourceStatus),
+				Reason:   aws.StringValue(e.ResourceStatusReason),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Events are returned newest first.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// waitForStatus polls the stack until it reaches the target status, logging
+// the stack events which are not in seen. It fails as soon as the stack ends
+// up in another stable state.
+func (c *Environment) waitForStatus(target string, seen map[string]bool) error {
+	for {
+		events := []*cloudformation.StackEvent{}
+		err := c.cf.DescribeStackEventsPages(&cloudformation.DescribeStackEventsInput{
+			StackName: aws.String(c.id),
+		}, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+			for _, e := range page.StackEvents {
+				if seen[aws.StringValue(e.EventId)] {
+					// Events are returned newest first.
+					return false
+				}
+				events = append(events, e)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := len(events) - 1; i >= 0; i-- {
+			e := events[i]
+			if seen[*e.EventId] {
+				continue
+			}
+			seen[*e.EventId] = true
+			c.log.Infof("  %s %s %s %s", e.Timestamp.Format("15:04:05"), aws.StringValue(e.LogicalResourceId),
+				aws.StringValue(e.ResourceStatus), aws.StringValue(e.ResourceStatusReason))
+		}
+
+		output, err := c.cf.DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(c.id),
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Stacks) != 1 {
+			return errors.New("stack not found")
+		}
+		status := *output.Stacks[0].StackStatus
+		switch {
+		case status == target:
+			return nil
+		case !strings.HasSuffix(status, "_IN_PROGRESS"):
+			return errors.Errorf("stack reached %s instead of %s: %s", status, target,
+				aws.StringValue(output.Stacks[0].StackStatusReason))
+		}
+
+		time.Sleep(stackPollInterval)
+	}
 }
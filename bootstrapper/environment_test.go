@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func testEnvironmentConfig() *EnvironmentConfig {
+	return &EnvironmentConfig{
+		Template:     "https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",
+		SSHKeyName:   "swarm",
+		Managers:     3,
+		Workers:      5,
+		InstanceType: "t2.micro",
+	}
+}
+
+func TestParseSSHOutput(t *testing.T) {
+	for _, c := range []struct {
+		output   string
+		endpoint string
+	}{
+		{"ssh docker@docker-e2e-20160928-ELB-SSH-1653593963.us-east-1.elb.amazonaws.com", "docker-e2e-20160928-ELB-SSH-1653593963.us-east-1.elb.amazonaws.com:22"},
+		{"ssh docker@10.0.0.1 ", "10.0.0.1:22"},
+		{"ssh docker@127.0.0.1:2222", "127.0.0.1:2222"},
+	} {
+		endpoint, err := parseSSHOutput(c.output)
+		assert.NoError(t, err, c.output)
+		assert.Equal(t, c.endpoint, endpoint)
+	}
+
+	for _, output := range []string{"", "ssh docker", "ssh docker@"} {
+		_, err := parseSSHOutput(output)
+		assert.Error(t, err, "%q should not parse", output)
+	}
+}
+
+func TestSSHEndpoint(t *testing.T) {
+	cf := newFakeCloudFormation()
+	id := cf.AddStack("docker-e2e-20160928-0", cloudformation.StackStatusCreateComplete, time.Now())
+
+	endpoint, err := NewEnvironment(id, cf, nil).sshEndpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "docker-e2e-20160928-0-ELB-SSH.us-east-1.elb.amazonaws.com:22", endpoint)
+
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"DefaultDNSTarget": "elb.example.com"}
+	}
+	id = cf.AddStack("docker-e2e-20160928-1", cloudformation.StackStatusCreateComplete, time.Now())
+	_, err = NewEnvironment(id, cf, nil).sshEndpoint()
+	assert.Error(t, err, "stack without SSH output")
+
+	_, err = NewEnvironment("missing", cf, nil).sshEndpoint()
+	assert.Error(t, err, "missing stack")
+}
+
+func TestPurge(t *testing.T) {
+	cf := newFakeCloudFormation()
+	old := time.Now().UTC().Add(-2 * time.Hour)
+
+	expired := cf.AddStack("docker-e2e-20160928-0", cloudformation.StackStatusCreateComplete, old)
+	recent := cf.AddStack("docker-e2e-20160928-1", cloudformation.StackStatusCreateComplete, time.Now().UTC())
+	pooled := cf.AddStack("docker-e2e-20160928-2", cloudformation.StackStatusCreateComplete, old)
+	failed := cf.AddStack("docker-e2e-20160928-3", cloudformation.StackStatusRollbackComplete, old)
+	other := cf.AddStack("production", cloudformation.StackStatusCreateComplete, old)
+	similar := cf.AddStack("docker-e2e2-20160928-0", cloudformation.StackStatusCreateComplete, old)
+
+	err := Purge(cf, "docker-e2e", time.Hour, map[string]bool{pooled: true})
+	assert.NoError(t, err)
+
+	for id, status := range map[string]string{
+		expired: cloudformation.StackStatusDeleteComplete,
+		recent:  cloudformation.StackStatusCreateComplete,
+		pooled:  cloudformation.StackStatusCreateComplete,
+		failed:  cloudformation.StackStatusDeleteComplete,
+		other:   cloudformation.StackStatusCreateComplete,
+		similar: cloudformation.StackStatusCreateComplete,
+	} {
+		assert.Equal(t, status, *cf.Stack(id).StackStatus, *cf.Stack(id).StackName)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	cf := newFakeCloudFormation()
+	config := testEnvironmentConfig()
+	config.Tags = map[string]string{"owner": "ci"}
+
+	env, err := Provision(cf, "docker-e2e-20160928-0", config)
+	assert.NoError(t, err)
+	assert.NotNil(t, env)
+
+	stack := cf.Stack(env.id)
+	assert.Equal(t, config.Template, cf.Template(env.id))
+
+	params := map[string]string{}
+	for _, p := range stack.Parameters {
+		params[*p.ParameterKey] = *p.ParameterValue
+	}
+	assert.Equal(t, map[string]string{
+		"KeyName":             "swarm",
+		"ClusterSize":         "5",
+		"ManagerSize":         "3",
+		"InstanceType":        "t2.micro",
+		"ManagerInstanceType": "t2.micro",
+	}, params)
+
+	tags := map[string]string{}
+	for _, tag := range stack.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	assert.Equal(t, map[string]string{"docker": "e2e", "owner": "ci"}, tags)
+}
+
+func TestProvisionLocalTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "template")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Resources": {}}`)
+	f.Close()
+
+	cf := newFakeCloudFormation()
+	config := testEnvironmentConfig()
+	config.Template = f.Name()
+
+	env, err := Provision(cf, "docker-e2e-20160928-0", config)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Resources": {}}`, cf.Template(env.id))
+}
+
+func TestProvisionFailure(t *testing.T) {
+	cf := newFakeCloudFormation()
+	cf.FailCreate["docker-e2e-20160928-0"] = true
+
+	_, err := Provision(cf, "docker-e2e-20160928-0", testEnvironmentConfig())
+	assert.Error(t, err)
+
+	config := testEnvironmentConfig()
+	config.Managers = 4
+	_, err = Provision(cf, "docker-e2e-20160928-1", config)
+	assert.Error(t, err, "invalid config")
+	assert.Nil(t, cf.Stack("docker-e2e-20160928-1"), "invalid config must not create a stack")
+}
+
+func TestUpdate(t *testing.T) {
+	stackPollInterval = time.Millisecond
+
+	cf := newFakeCloudFormation()
+	env, err := Provision(cf, "docker-e2e-20160928-0", testEnvironmentConfig())
+	assert.NoError(t, err)
+
+	upgraded := testEnvironmentConfig()
+	upgraded.Template = "https://docker-for-aws.s3.amazonaws.com/aws/beta/latest.json"
+	assert.NoError(t, env.Update(upgraded))
+	assert.Equal(t, upgraded.Template, cf.Template(env.id))
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+	cf.FailUpdate = true
+	err = env.Update(testEnvironmentConfig())
+	assert.Error(t, err)
+	assert.Contains(t, logs.String(), " UPDATE_ROLLBACK_COMPLETE")
+	assert.NotContains(t, logs.String(), " UPDATE_COMPLETE", "events of the previous update must not be logged")
+	assert.Contains(t, err.Error(), cloudformation.StackStatusUpdateRollbackComplete)
+	assert.Equal(t, upgraded.Template, cf.Template(env.id), "failed update must keep the template")
+}
+
+func TestDestroy(t *testing.T) {
+	cf := newFakeCloudFormation()
+	env, err := Provision(cf, "docker-e2e-20160928-0", testEnvironmentConfig())
+	assert.NoError(t, err)
+
+	assert.NoError(t, env.Destroy())
+	assert.Equal(t, cloudformation.StackStatusDeleteComplete, aws.StringValue(cf.Stack(env.id).StackStatus))
+}
+
+func TestRun(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	var stdout bytes.Buffer
+	result, err := env.Run("echo out; echo err >&2", nil, &stdout, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(result.Stdout))
+	assert.Equal(t, "err\n", string(result.Stderr))
+	assert.Equal(t, "out\n", stdout.String(), "output must be copied live")
+	assert.Equal(t, 0, result.ExitStatus)
+
+	result, err = env.Run("exit 3", nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 3, result.ExitStatus)
+
+	server.ExitCodes["docker run dockerswarm/e2e"] = 1
+	result, err = env.Run("docker run dockerswarm/e2e", nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, result.ExitStatus)
+
+	server.Delay = 50 * time.Millisecond
+	result, err = env.Run("true", nil, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, result.Duration >= server.Delay, "duration %v", result.Duration)
+}
+
+func TestRunEnv(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	vars := map[string]string{"DOCKER_E2E_ENDPOINT": "10.0.0.1", "QUOTED": "it's"}
+	for _, accept := range []bool{true, false} {
+		server.AcceptEnv = accept
+		result, err := env.Run(`echo "$DOCKER_E2E_ENDPOINT $QUOTED"`, vars, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.1 it's\n", string(result.Stdout), "setenv accepted: %v", accept)
+		assert.Equal(t, `echo "$DOCKER_E2E_ENDPOINT $QUOTED"`, result.Command, "values must not leak in the command")
+	}
+}
+
+func TestRunDisconnect(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	server.Disconnect["reboot"] = true
+	result, err := env.Run("reboot", nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, -1, result.ExitStatus)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// historyBucket holds the runs, keyed by their ID in big endian so they are
+// iterated in order.
+var historyBucket = []byte("runs")
+
+// HistoryRecord is a run saved in the history.
+type HistoryRecord struct {
+	ID uint64 `json:"id"`
+	// Command is the bootstrapper command which ran, e.g. "run".
+	Command string `json:"command"`
+	// Config is the path of the config file.
+	Config string `json:"config"`
+	// RunID is the run_id field of the logs of the run.
+	RunID string `json:"run_id,omitempty"`
+
+	*RunReport
+}
+
+// Template returns the template of the environment of the run.
+func (r *HistoryRecord) Template() string {
+	if r.Environment == nil {
+		return ""
+	}
+	return r.Environment.Template
+}
+
+// TestStatus returns the status of a test in the run, or "" if it didn't run.
+// Tests run several times count with their last result.
+func (r *HistoryRecord) TestStatus(name string) string {
+	return testStatus(r.Tests(), name)
+}
+
+// testFlaky returns whether a test of the run passed after failing.
+func (r *HistoryRecord) testFlaky(name string) bool {
+	for _, t := range r.Tests() {
+		if t.Name == name && t.Flaky {
+			return true
+		}
+	}
+	return false
+}
+
+// History is a local database of the runs.
+type History struct {
+	db *bolt.DB
+}
+
+// defaultHistoryPath returns the location of the history if none is
+// specified.
+func defaultHistoryPath() string {
+	usr, err := user.Current()
+	if err != nil {
+		return "docker-e2e-history.db"
+	}
+	return filepath.Join(usr.HomeDir, ".docker-e2e", "history.db")
+}
+
+// OpenHistory opens the history at path, creating it if needed. It must be
+// closed once done, as only one process can have it open at a time.
+func OpenHistory(path string) (*History, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 30 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open history %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &History{db: db}, nil
+}
+
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+// Add saves a run, setting its ID.
+func (h *History) Add(record *HistoryRecord) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.ID = id
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put(historyKey(id), data)
+	})
+}
+
+// Get returns the run with the given ID.
+func (h *History) Get(id uint64) (*HistoryRecord, error) {
+	var record *HistoryRecord
+	err := h.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(historyBucket).Get(historyKey(id))
+		if data == nil {
+			return errors.Errorf("no run %d in the history", id)
+		}
+		record = &HistoryRecord{}
+		return json.Unmarshal(data, record)
+	})
+	return record, err
+}
+
+// HistoryFilter selects runs of the history. Zero values match everything.
+type HistoryFilter struct {
+	// Template matches runs whose template contains it.
+	Template string
+	// Test matches runs which ran the test.
+	Test string
+	// Failed only matches failed runs.
+	Failed bool
+	// Since matches runs started after it.
+	Since time.Time
+	// Limit is the maximum number of runs returned.
+	Limit int
+}
+
+func (f HistoryFilter) match(r *HistoryRecord) bool {
+	if f.Template != "" && !strings.Contains(r.Template(), f.Template) {
+		return false
+	}
+	if f.Test != "" && r.TestStatus(f.Test) == "" {
+		return false
+	}
+	if f.Failed && !r.Failed() {
+		return false
+	}
+	return f.Since.IsZero() || r.Start.After(f.Since)
+}
+
+// List returns the runs matching filter, most recent first.
+func (h *History) List(filter HistoryFilter) ([]*HistoryRecord, error) {
+	records := []*HistoryRecord{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			record := &HistoryRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return errors.Wrapf(err, "corrupted run %d", binary.BigEndian.Uint64(k))
+			}
+			if !filter.match(record) {
+				continue
+			}
+			records = append(records, record)
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func historyKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// TestFlakiness counts how often a test was flaky.
+type TestFlakiness struct {
+	Name string
+	// Runs is the number of runs of the test, Flaky the number of them in
+	// which it passed after failing.
+	Runs  int
+	Flaky int
+}
+
+// Score is the ratio of the runs in which the test was flaky.
+func (f TestFlakiness) Score() float64 {
+	if f.Runs == 0 {
+		return 0
+	}
+	return float64(f.Flaky) / float64(f.Runs)
+}
+
+// flakiness returns the tests which were flaky in records, the flakiest
+// first.
+func flakiness(records []*HistoryRecord) []TestFlakiness {
+	counts := map[string]*TestFlakiness{}
+	for _, r := range records {
+		seen := map[string]bool{}
+		for _, t := range r.Tests() {
+			if seen[t.Name] {
+				continue
+			}
+			seen[t.Name] = true
+			f, ok := counts[t.Name]
+			if !ok {
+				f = &TestFlakiness{Name: t.Name}
+				counts[t.Name] = f
+			}
+			f.Runs++
+			if r.testFlaky(t.Name) {
+				f.Flaky++
+			}
+		}
+	}
+
+	flaky := byFlakiness{}
+	for _, f := range counts {
+		if f.Flaky > 0 {
+			flaky = append(flaky, *f)
+		}
+	}
+	sort.Sort(flaky)
+	return flaky
+}
+
+type byFlakiness []TestFlakiness
+
+func (b byFlakiness) Len() int      { return len(b) }
+func (b byFlakiness) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byFlakiness) Less(i, j int) bool {
+	if b[i].Score() != b[j].Score() {
+		return b[i].Score() > b[j].Score()
+	}
+	return b[i].Name < b[j].Name
+}
+
+// TestChange is a test whose status differs between two runs. An empty
+// status means the test didn't run.
+type TestChange struct {
+	Name   string
+	Before string
+	After  string
+}
+
+// diffRuns returns the tests whose status changed from before to after,
+// sorted by name.
+func diffRuns(before, after *HistoryRecord) []TestChange {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, r := range []*HistoryRecord{before, after} {
+		for _, t := range r.Tests() {
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				names = append(names, t.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	changes := []TestChange{}
+	for _, name := range names {
+		b, a := before.TestStatus(name), after.TestStatus(name)
+		if b != a {
+			changes = append(changes, TestChange{Name: name, Before: b, After: a})
+		}
+	}
+	return changes
+}
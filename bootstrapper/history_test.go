@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testHistoryRecord(template string, start time.Time, tests ...TestResult) *HistoryRecord {
+	config := testEnvironmentConfig()
+	config.Template = template
+	return &HistoryRecord{
+		Command: "run",
+		Config:  "e2e.yml",
+		RunReport: &RunReport{
+			Environment: config,
+			Start:       start,
+			Steps:       []StepReport{{Command: "go test -v ./tests", Tests: tests}},
+		},
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	history, err := OpenHistory(filepath.Join(dir, "history.db"))
+	assert.NoError(t, err)
+	defer history.Close()
+
+	now := time.Now()
+	nightly := "https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json"
+	beta := "https://docker-for-aws.s3.amazonaws.com/aws/beta/latest.json"
+	records := []*HistoryRecord{
+		testHistoryRecord(nightly, now.Add(-72*time.Hour), TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestPass}),
+		testHistoryRecord(beta, now.Add(-48*time.Hour), TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestPass}),
+		testHistoryRecord(nightly, now.Add(-24*time.Hour),
+			TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestFail},
+			TestResult{Name: "TestNetwork", Status: TestPass}),
+	}
+	records[2].Error = "exit status 1"
+	for _, r := range records {
+		assert.NoError(t, history.Add(r))
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, []uint64{records[0].ID, records[1].ID, records[2].ID})
+
+	ids := func(filter HistoryFilter) []uint64 {
+		list, err := history.List(filter)
+		assert.NoError(t, err)
+		ids := []uint64{}
+		for _, r := range list {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []uint64{3, 2, 1}, ids(HistoryFilter{}))
+	assert.Equal(t, []uint64{3, 2}, ids(HistoryFilter{Limit: 2}))
+	assert.Equal(t, []uint64{3, 1}, ids(HistoryFilter{Template: "nightly"}))
+	assert.Equal(t, []uint64{3}, ids(HistoryFilter{Failed: true}))
+	assert.Equal(t, []uint64{3}, ids(HistoryFilter{Test: "TestNetwork"}))
+	assert.Equal(t, []uint64{3, 2}, ids(HistoryFilter{Since: now.Add(-50 * time.Hour)}))
+
+	record, err := history.Get(3)
+	assert.NoError(t, err)
+	assert.Equal(t, TestFail, record.TestStatus("TestServicesRollingUpdateSucceed"))
+	assert.Equal(t, "", record.TestStatus("TestMissing"))
+	assert.Equal(t, nightly, record.Template())
+
+	_, err = history.Get(4)
+	assert.Error(t, err)
+
+	before, err := history.Get(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []TestChange{
+		{Name: "TestNetwork", Before: "", After: TestPass},
+		{Name: "TestServicesRollingUpdateSucceed", Before: TestPass, After: TestFail},
+	}, diffRuns(before, record))
+	assert.Empty(t, diffRuns(record, record))
+}
+
+func TestHistoryFlakiness(t *testing.T) {
+	now := time.Now()
+	records := []*HistoryRecord{
+		testHistoryRecord("", now,
+			TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestPass, Attempts: 2, Flaky: true},
+			TestResult{Name: "TestNetwork", Status: TestPass}),
+		testHistoryRecord("", now,
+			TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestPass},
+			TestResult{Name: "TestNetwork", Status: TestPass, Attempts: 2, Flaky: true}),
+		testHistoryRecord("", now,
+			TestResult{Name: "TestServicesRollingUpdateSucceed", Status: TestFail, Attempts: 3},
+			TestResult{Name: "TestNetwork", Status: TestPass, Attempts: 2, Flaky: true}),
+		testHistoryRecord("", now, TestResult{Name: "TestServicesCreate", Status: TestPass}),
+	}
+
+	flaky := flakiness(records)
+	assert.Equal(t, []TestFlakiness{
+		{Name: "TestNetwork", Runs: 3, Flaky: 2},
+		{Name: "TestServicesRollingUpdateSucceed", Runs: 3, Flaky: 1},
+	}, flaky)
+	assert.InDelta(t, 0.67, flaky[0].Score(), 0.01)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// htmlReportName is the name of the HTML report in the artifacts directory.
+const htmlReportName = "report.html"
+
+// maxHTMLOutput is how much of the output of each command is embedded in the
+// HTML report. The end of the output is kept, since that's usually where
+// failures are.
+const maxHTMLOutput = 1 << 20
+
+// htmlRun is a run as shown in the HTML report.
+type htmlRun struct {
+	*RunReport
+	// Timeline has a bar per resource of the stack.
+	Timeline []timelineBar
+	Steps    []htmlStep
+	// Artifacts are the files of the run, relative to the report.
+	Artifacts []string
+}
+
+// timelineBar shows when a resource of the stack was created, in percents of
+// the provisioning time.
+type timelineBar struct {
+	Resource string
+	Type     string
+	Status   string
+	Reason   string
+	Duration time.Duration
+	Offset   float64
+	Width    float64
+	Failed   bool
+}
+
+// htmlStep is a command of a run, with its output.
+type htmlStep struct {
+	StepReport
+	Name        string
+	Stdout      string
+	Stderr      string
+	Quarantined map[string]bool
+}
+
+// Failed returns whether the command failed.
+func (s htmlStep) Failed() bool {
+	return s.ExitStatus != 0 || s.Signal != ""
+}
+
+// writeHTMLReport saves a page summarizing runs in dir. The artifacts of each
+// run are expected in the subdirectory named after it, as for matrix runs, or
+// in dir if it has no name.
+func writeHTMLReport(dir string, reports ...*RunReport) error {
+	runs := []htmlRun{}
+	for _, r := range reports {
+		runs = append(runs, newHTMLRun(dir, r))
+	}
+	var buf bytes.Buffer
+	err := htmlReportTemplate.Execute(&buf, map[string]interface{}{
+		"Generated": time.Now(),
+		"Runs":      runs,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, htmlReportName), buf.Bytes(), 0644)
+}
+
+// saveHTMLReport writes the HTML report of a run in its artifacts directory,
+// if any. Failing to do so doesn't fail the run.
+func saveHTMLReport(config *Config, reports ...*RunReport) {
+	if config.Artifacts == "" {
+		return
+	}
+	if err := os.MkdirAll(config.Artifacts, 0755); err != nil {
+		config.logger().Errorf("Unable to write the HTML report: %v", err)
+		return
+	}
+	if err := writeHTMLReport(config.Artifacts, reports...); err != nil {
+		config.logger().Errorf("Unable to write the HTML report: %v", err)
+	}
+}
+
+func newHTMLRun(dir string, r *RunReport) htmlRun {
+	run := htmlRun{RunReport: r, Timeline: timeline(r.Events)}
+
+	// The artifacts are in the directory of the run, and in the ones of the
+	// steps, such as the phases of an upgrade.
+	dirs := []string{filepath.Join(dir, r.Name)}
+	for i, step := range r.Steps {
+		s := htmlStep{
+			StepReport:  step,
+			Name:        stepName(i),
+			Quarantined: make(map[string]bool),
+		}
+		if step.Logs != "" {
+			s.Stdout = readOutput(step.Logs + ".stdout.log")
+			s.Stderr = readOutput(step.Logs + ".stderr.log")
+			dirs = append(dirs, filepath.Dir(step.Logs))
+		}
+		for _, name := range step.Quarantined {
+			s.Quarantined[name] = true
+		}
+		run.Steps = append(run.Steps, s)
+	}
+
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || f.Name() == htmlReportName {
+				continue
+			}
+			rel, err := filepath.Rel(dir, filepath.Join(d, f.Name()))
+			if err != nil || seen[rel] {
+				continue
+			}
+			seen[rel] = true
+			run.Artifacts = append(run.Artifacts, filepath.ToSlash(rel))
+		}
+	}
+	return run
+}
+
+// readOutput returns the end of an output file, or "" if it can't be read.
+func readOutput(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+
+	prefix := ""
+	if skip := info.Size() - maxHTMLOutput; skip > 0 {
+		if _, err := f.Seek(skip, io.SeekStart); err != nil {
+			return ""
+		}
+		prefix = fmt.Sprintf("[%d bytes skipped, see %s]\n", skip, filepath.Base(path))
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	return prefix + string(data)
+}
+
+// timeline returns a bar per resource of the stack, from its first event to
+// its last one, in the order the resources were first seen.
+func timeline(events []StackEvent) []timelineBar {
+	if len(events) == 0 {
+		return nil
+	}
+	start, end := events[0].Time, events[0].Time
+	first := make(map[string]StackEvent)
+	last := make(map[string]StackEvent)
+	order := []string{}
+	for _, e := range events {
+		if e.Time.Before(start) {
+			start = e.Time
+		}
+		if e.Time.After(end) {
+			end = e.Time
+		}
+		if _, ok := first[e.Resource]; !ok {
+			first[e.Resource] = e
+			order = append(order, e.Resource)
+		}
+		last[e.Resource] = e
+	}
+	total := end.Sub(start)
+
+	bars := []timelineBar{}
+	for _, resource := range order {
+		f, l := first[resource], last[resource]
+		bar := timelineBar{
+			Resource: resource,
+			Type:     l.Type,
+			Status:   l.Status,
+			Reason:   l.Reason,
+			Duration: l.Time.Sub(f.Time),
+			Width:    100,
+			Failed:   isFailedStatus(l.Status),
+		}
+		if total > 0 {
+			bar.Offset = 100 * float64(f.Time.Sub(start)) / float64(total)
+			bar.Width = 100 * float64(bar.Duration) / float64(total)
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+// isFailedStatus returns whether a resource status is a failure.
+func isFailedStatus(status string) bool {
+	return strings.HasSuffix(status, "_FAILED")
+}
+
+// roundDuration shortens durations for display.
+func roundDuration(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d - d%(100*time.Millisecond)
+	}
+	return d - d%time.Millisecond
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"duration": roundDuration,
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.2f%%", f)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>docker-e2e report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: .2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { text-align: left; padding: .2em .5em; border-bottom: 1px solid #eee; vertical-align: top; }
+pre { background: #f6f6f6; padding: .5em; overflow-x: auto; white-space: pre-wrap; }
+details { margin: .5em 0; }
+summary { cursor: pointer; }
+.pass { color: #197b30; }
+.fail { color: #b31d28; font-weight: bold; }
+.skip, .quarantined { color: #8a6d00; }
+.track { position: relative; background: #f0f0f0; height: 1em; min-width: 20em; }
+.bar { position: absolute; height: 100%; background: #4a90d9; min-width: 2px; }
+.bar.failed { background: #b31d28; }
+</style>
+</head>
+<body>
+<h1>docker-e2e report</h1>
+<p>Generated {{time .Generated}}</p>
+{{range .Runs}}
+<h2>{{if .Name}}{{.Name}}: {{end}}{{if .Failed}}<span class="fail">FAILED</span>{{else}}<span class="pass">PASSED</span>{{end}}</h2>
+<table>
+{{with .Environment}}<tr><th>Template</th><td>{{.Template}}</td></tr>
+<tr><th>Nodes</th><td>{{.Managers}} managers, {{.Workers}} workers ({{.InstanceType}})</td></tr>{{end}}
+{{if .StackID}}<tr><th>Stack</th><td>{{.StackID}}</td></tr>{{end}}
+<tr><th>Started</th><td>{{time .Start}}</td></tr>
+<tr><th>Duration</th><td>{{duration .Duration}} (provisioning {{duration .Provisioning}}, SSH {{duration .Connect}})</td></tr>
+{{if .TestRun}}<tr><th>Tests</th><td>{{.TestRun}}</td></tr>{{end}}
+{{if .Error}}<tr><th>Error</th><td class="fail">{{.Error}}</td></tr>{{end}}
+</table>
+
+{{if .Timeline}}
+<h3>Provisioning</h3>
+<table>
+<tr><th>Resource</th><th>Status</th><th>Duration</th><th>Timeline</th></tr>
+{{range .Timeline}}<tr>
+<td>{{.Resource}}{{if .Type}} <small>{{.Type}}</small>{{end}}</td>
+<td{{if .Failed}} class="fail"{{end}}>{{.Status}}{{if .Reason}}<br><small>{{.Reason}}</small>{{end}}</td>
+<td>{{duration .Duration}}</td>
+<td><div class="track"><div class="bar{{if .Failed}} failed{{end}}" style="left: {{percent .Offset}}; width: {{percent .Width}}"></div></div></td>
+</tr>{{end}}
+</table>
+{{end}}
+
+{{if .Steps}}
+<h3>Commands</h3>
+{{range .Steps}}
+<details{{if .Failed}} open{{end}}>
+<summary><span class="{{if .Failed}}fail{{else}}pass{{end}}">{{if .Failed}}FAIL{{else}}OK{{end}}</span>
+<code>{{.Command}}</code> {{duration .Duration}}{{if .Failed}}, exit status {{.ExitStatus}}{{if .Signal}} ({{.Signal}}){{end}}{{end}}</summary>
+{{if .Tests}}
+<table>
+<tr><th>Test</th><th>Result</th><th>Duration</th></tr>
+{{$step := .}}{{range .Tests}}<tr>
+<td>{{.Name}}</td>
+<td>{{if index $step.Quarantined .Name}}<span class="quarantined">{{.Status}} (quarantined)</span>{{else if eq .Status "PASS"}}<span class="pass">PASS</span>{{else if eq .Status "FAIL"}}<span class="fail">FAIL</span>{{else}}<span class="skip">{{.Status}}</span>{{end}}{{if .Attempts}} after {{.Attempts}} attempts{{end}}{{if .Flaky}}, flaky{{end}}
+{{if .Output}}<pre>{{.Output}}</pre>{{end}}</td>
+<td>{{duration .Duration}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+{{if .Stdout}}<details><summary>stdout</summary><pre>{{.Stdout}}</pre></details>{{end}}
+{{if .Stderr}}<details><summary>stderr</summary><pre>{{.Stderr}}</pre></details>{{end}}
+</details>
+{{end}}
+{{end}}
+
+{{if .Artifacts}}
+<h3>Artifacts</h3>
+<ul>
+{{range .Artifacts}}<li><a href="{{.}}">{{.}}</a></li>
+{{end}}</ul>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeline(t *testing.T) {
+	start := time.Date(2017, 3, 15, 2, 0, 0, 0, time.UTC)
+	bars := timeline([]StackEvent{
+		{Time: start, Resource: "docker-e2e-1", Status: "CREATE_IN_PROGRESS"},
+		{Time: start.Add(10 * time.Second), Resource: "Vpc", Type: "AWS::EC2::VPC", Status: "CREATE_IN_PROGRESS"},
+		{Time: start.Add(30 * time.Second), Resource: "Vpc", Type: "AWS::EC2::VPC", Status: "CREATE_COMPLETE"},
+		{Time: start.Add(40 * time.Second), Resource: "ManagerAsg", Status: "CREATE_IN_PROGRESS"},
+		{Time: start.Add(90 * time.Second), Resource: "ManagerAsg", Status: "CREATE_FAILED", Reason: "timed out"},
+		{Time: start.Add(100 * time.Second), Resource: "docker-e2e-1", Status: "ROLLBACK_COMPLETE"},
+	})
+	assert.Equal(t, []timelineBar{
+		{Resource: "docker-e2e-1", Status: "ROLLBACK_COMPLETE", Duration: 100 * time.Second, Width: 100},
+		{Resource: "Vpc", Type: "AWS::EC2::VPC", Status: "CREATE_COMPLETE", Duration: 20 * time.Second, Offset: 10, Width: 20},
+		{Resource: "ManagerAsg", Status: "CREATE_FAILED", Reason: "timed out", Duration: 50 * time.Second, Offset: 40, Width: 50, Failed: true},
+	}, bars)
+	assert.Nil(t, timeline(nil))
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runDir := filepath.Join(dir, "ubuntu")
+	assert.NoError(t, os.Mkdir(runDir, 0755))
+	for name, content := range map[string]string{
+		"step-01.stdout.log": "--- FAIL: TestServices (61.00s)\n<script>alert(1)</script>\n",
+		"step-01.stderr.log": "",
+		"outputs.json":       "{}",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(runDir, name), []byte(content), 0644))
+	}
+
+	start := time.Date(2017, 3, 15, 2, 0, 0, 0, time.UTC)
+	assert.NoError(t, writeHTMLReport(dir, &RunReport{
+		Name:        "ubuntu",
+		StackID:     "arn:aws:cloudformation:us-east-1:123:stack/docker-e2e-1/1",
+		Environment: testEnvironmentConfig(),
+		Start:       start,
+		Duration:    10 * time.Minute,
+		Events: []StackEvent{
+			{Time: start, Resource: "docker-e2e-1", Status: "CREATE_IN_PROGRESS"},
+			{Time: start.Add(time.Minute), Resource: "ManagerAsg", Status: "CREATE_COMPLETE"},
+		},
+		Steps: []StepReport{{
+			Command:    "go test -v",
+			ExitStatus: 1,
+			Tests: []TestResult{
+				{Name: "TestServices", Status: TestFail, Output: "services_test.go:120: timed out\n"},
+				{Name: "TestNetwork", Status: TestFail},
+			},
+			Quarantined: []string{"TestNetwork"},
+			Logs:        filepath.Join(runDir, "step-01"),
+		}},
+		Error: "exit status 1",
+	}))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, htmlReportName))
+	assert.NoError(t, err)
+	page := string(data)
+	for _, s := range []string{
+		"ubuntu: <span class=\"fail\">FAILED</span>",
+		"ManagerAsg",
+		"left: 100.00%; width: 0.00%",
+		"<details open>",
+		"services_test.go:120: timed out",
+		"FAIL (quarantined)",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		`<a href="ubuntu/outputs.json">ubuntu/outputs.json</a>`,
+	} {
+		assert.Contains(t, page, s)
+	}
+	assert.NotContains(t, page, "<script>")
+	assert.NotContains(t, page, "stderr</summary>", "empty outputs must be omitted")
+}
+
+func TestUpgradeHTMLReport(t *testing.T) {
+	stackPollInterval = time.Millisecond
+	server := newTestSSHServer(t)
+	defer server.Close()
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Environment: server.environmentConfig(),
+		Upgrade: &Upgrade{
+			Template: "https://docker-for-aws.s3.amazonaws.com/aws/beta/latest.json",
+			Before:   []Command{{Run: "echo output before"}},
+			After:    []Command{{Run: "echo output after"}},
+		},
+		Artifacts: dir,
+		Quiet:     true,
+	}
+	report := runUpgrade(cf, config)
+	assert.False(t, report.Failed(), report.Error)
+	assert.NoError(t, writeHTMLReport(dir, report))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, htmlReportName))
+	assert.NoError(t, err)
+	page := string(data)
+	for _, s := range []string{
+		"<pre>output before\n</pre>",
+		"<pre>output after\n</pre>",
+		`<a href="before/step-01.stdout.log">`,
+		`<a href="after/step-01.stdout.log">`,
+	} {
+		assert.Contains(t, page, s)
+	}
+}
+
+func TestReadOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "output")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(strings.Repeat("x", maxHTMLOutput) + "the end\n")
+	f.Close()
+
+	output := readOutput(f.Name())
+	assert.True(t, strings.HasPrefix(output, "[8 bytes skipped, see "+filepath.Base(f.Name())+"]\n"))
+	assert.True(t, strings.HasSuffix(output, "the end\n"))
+	assert.Empty(t, readOutput(f.Name()+".missing"))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// remoteTestsPath is where the locally built tests are uploaded on the
+// manager.
+var remoteTestsPath = "/tmp/docker-e2e.test"
+
+// localTestsCommand runs the uploaded tests. The -run pattern is in
+// $DOCKER_E2E_TEST_RUN, so that retries can run the same command.
+func localTestsCommand() string {
+	return fmt.Sprintf(`%s -test.v -test.run "$%s"`, shellQuote(remoteTestsPath), testRunVar)
+}
+
+// The platform of the nodes, which the tests are built for.
+var (
+	localTestsOS   = "linux"
+	localTestsArch = "amd64"
+)
+
+// buildLocalTests compiles the tests package in dir for the nodes with
+// "go test -c". The binary is in a temporary directory, removed by cleanup.
+func buildLocalTests(dir string) (binary string, cleanup func(), err error) {
+	tmp, err := ioutil.TempDir("", "docker-e2e-tests")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(tmp) }
+
+	binary = filepath.Join(tmp, "docker-e2e.test")
+	cmd := exec.Command("go", "test", "-c", "-o", binary, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS="+localTestsOS, "GOARCH="+localTestsArch, "CGO_ENABLED=0")
+	if !inModule(dir) {
+		// The tests are in a GOPATH, as for go 1.7, which newer versions
+		// only build with modules off.
+		cmd.Env = append(cmd.Env, "GO111MODULE=off")
+	}
+	logrus.Infof("Building the tests in %s", dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, errors.Errorf("unable to build the tests in %s: %v\n%s", dir, err, output)
+	}
+	return binary, cleanup, nil
+}
+
+// inModule reports whether dir is in a go module, with a go.mod in it or one
+// of its parents.
+func inModule(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// localTestsConfig returns the config running the tests built at binary
+// instead of its commands. The tests selected by pattern are run, all of them
+// if it's empty. They replace the command with a retry, which is the one
+// running the tests, or the last one; chaos steps are kept around them and
+// the other commands are dropped.
+func localTestsConfig(config *Config, binary, pattern string) *Config {
+	c := *config
+	c.localTests = binary
+
+	tests := -1
+	for i, cmd := range config.Commands {
+		if cmd.Chaos != nil {
+			continue
+		}
+		tests = i
+		if cmd.Retry != nil {
+			break
+		}
+	}
+	c.Commands = nil
+	var dropped []string
+	for i, cmd := range config.Commands {
+		switch {
+		case cmd.Chaos != nil:
+			c.Commands = append(c.Commands, cmd)
+		case i == tests:
+			command := Command{Run: localTestsCommand(), Env: cmd.Env}
+			if cmd.Retry != nil {
+				command.Retry = &Retry{Attempts: cmd.Retry.Attempts, Run: command.Run}
+			}
+			c.Commands = append(c.Commands, command)
+		default:
+			dropped = append(dropped, cmd.Run)
+		}
+	}
+	if tests < 0 {
+		c.Commands = append(c.Commands, Command{Run: localTestsCommand()})
+	}
+	if len(dropped) > 0 {
+		logrus.Warnf("Not running the commands replaced by the local tests: %s", strings.Join(dropped, "; "))
+	}
+
+	c.Env = map[string]EnvValue{}
+	for name, value := range config.Env {
+		c.Env[name] = value
+	}
+	if pattern != "" {
+		c.Env[testRunVar] = EnvValue{Value: pattern}
+	}
+	return &c
+}
+
+// uploadLocalTests copies the tests built for the config, if any, to the
+// manager.
+func uploadLocalTests(c *Environment, cfg *Config) error {
+	if cfg.localTests == "" {
+		return nil
+	}
+	f, err := os.Open(cfg.localTests)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg.logger().Infof("Uploading the tests to %s", remoteTestsPath)
+	return c.Upload(f, remoteTestsPath, 0755)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// localTestsPackage is a tests package with a passing and a failing test. As
+// the tests of the repository, it is built in a GOPATH, without a go.mod.
+var localTestsPackage = map[string]string{
+	"e2e_test.go": `package e2e
+
+import "testing"
+
+func TestPass(t *testing.T) {}
+
+func TestFail(t *testing.T) { t.Fatal("failed") }
+`,
+}
+
+func TestLocalTestsConfig(t *testing.T) {
+	stopDocker := Command{Chaos: &Chaos{Action: chaosStopDocker, Target: NodeSelector{Role: roleWorker}}}
+	restore := Command{Chaos: &Chaos{Action: chaosRestore}}
+	config := &Config{
+		Env: map[string]EnvValue{"FOO": {Value: "bar"}},
+		Commands: []Command{
+			{Run: "docker version"},
+			stopDocker,
+			{Run: "docker run dockerswarm/e2e", Env: map[string]EnvValue{"BAZ": {Value: "qux"}}, Retry: &Retry{Attempts: 2, Run: "docker run dockerswarm/e2e go test -v -run \"$DOCKER_E2E_TEST_RUN\""}},
+			restore,
+			{Run: "docker info"},
+		},
+	}
+	c := localTestsConfig(config, "/build/docker-e2e.test", "TestServices")
+	assert.Equal(t, "/build/docker-e2e.test", c.localTests)
+	assert.Equal(t, []Command{stopDocker, {
+		Run:   `'/tmp/docker-e2e.test' -test.v -test.run "$DOCKER_E2E_TEST_RUN"`,
+		Env:   map[string]EnvValue{"BAZ": {Value: "qux"}},
+		Retry: &Retry{Attempts: 2, Run: `'/tmp/docker-e2e.test' -test.v -test.run "$DOCKER_E2E_TEST_RUN"`},
+	}, restore}, c.Commands, "chaos steps must be kept around the tests")
+	assert.Equal(t, map[string]EnvValue{"FOO": {Value: "bar"}, testRunVar: {Value: "TestServices"}}, c.Env)
+
+	assert.Len(t, config.Commands, 5, "the original config must not change")
+	assert.NotContains(t, config.Env, testRunVar)
+
+	c = localTestsConfig(config, "/build/docker-e2e.test", "")
+	assert.NotContains(t, c.Env, testRunVar)
+
+	// Without a retry, the tests replace the last command.
+	config.Commands = []Command{{Run: "docker version"}, stopDocker, {Run: "docker run dockerswarm/e2e"}}
+	c = localTestsConfig(config, "/build/docker-e2e.test", "")
+	assert.Equal(t, []Command{stopDocker, {Run: `'/tmp/docker-e2e.test' -test.v -test.run "$DOCKER_E2E_TEST_RUN"`}}, c.Commands)
+
+	config.Commands = []Command{stopDocker}
+	c = localTestsConfig(config, "/build/docker-e2e.test", "")
+	assert.Equal(t, []Command{stopDocker, {Run: `'/tmp/docker-e2e.test' -test.v -test.run "$DOCKER_E2E_TEST_RUN"`}}, c.Commands)
+}
+
+func TestUpload(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "it's.sh")
+
+	assert.NoError(t, env.Upload(strings.NewReader("#!/bin/sh\necho uploaded\n"), path, 0755))
+	result, err := env.Run(shellQuote(path), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "uploaded\n", string(result.Stdout))
+
+	assert.Error(t, env.Upload(strings.NewReader(""), filepath.Join(dir, "missing", "file"), 0644))
+}
+
+func TestRunLocalTests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a tests package")
+	}
+	if runtime.GOOS != localTestsOS || runtime.GOARCH != localTestsArch {
+		t.Skipf("tests built for %s/%s can't run on %s/%s", localTestsOS, localTestsArch, runtime.GOOS, runtime.GOARCH)
+	}
+
+	gopath, err := ioutil.TempDir("", "local-tests")
+	assert.NoError(t, err)
+	defer os.RemoveAll(gopath)
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	os.Setenv("GOPATH", gopath)
+	dir := filepath.Join(gopath, "src", "e2e")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	for name, content := range localTestsPackage {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	_, _, err = buildLocalTests(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	binary, cleanup, err := buildLocalTests(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup()
+
+	defer func(path string) { remoteTestsPath = path }(remoteTestsPath)
+	remoteTestsPath = filepath.Join(dir, "docker-e2e.test")
+
+	server := newTestSSHServer(t)
+	defer server.Close()
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+	config := &Config{
+		Environment: server.environmentConfig(),
+		Commands:    []Command{{Run: "docker run dockerswarm/e2e"}},
+		Quiet:       true,
+	}
+	report := runEnvironment(cf, "", localTestsConfig(config, binary, "TestPass"))
+	assert.False(t, report.Failed(), report.Error)
+	assert.Equal(t, []TestResult{{Name: "TestPass", Status: TestPass}}, report.Tests())
+
+	report = runEnvironment(cf, "", localTestsConfig(config, binary, ""))
+	assert.True(t, report.Failed())
+	tests := report.Tests()
+	if assert.Len(t, tests, 2) {
+		assert.Equal(t, "TestFail", tests[1].Name)
+		assert.Equal(t, TestFail, tests[1].Status)
+	}
+}
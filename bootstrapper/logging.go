@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Formats of --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var (
+	// runID identifies the invocation of the bootstrapper, it is a field of
+	// every log entry. The jobs of serve log with their own, see Job and
+	// EnvironmentConfig.log.
+	runID string
+	// remoteOutputLogs is set when the output of remote commands is logged
+	// line by line rather than copied to the console as is.
+	remoteOutputLogs bool
+)
+
+// configureLogging sets the format and level of the logs, and tags every
+// entry with id, or a random run ID if empty.
+func configureLogging(format, level, id string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return errors.Errorf("invalid log level %q", level)
+	}
+	switch format {
+	case logFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+		remoteOutputLogs = false
+	case logFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		remoteOutputLogs = true
+	default:
+		return errors.Errorf("invalid log format %q, expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+	logrus.SetLevel(lvl)
+
+	if id == "" {
+		id = newRunID()
+	}
+	runID = id
+	logrus.AddHook(&fieldsHook{fields: logrus.Fields{"run_id": id}})
+	return nil
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// fieldsHook adds fields to every log entry which doesn't set them.
+type fieldsHook struct {
+	fields logrus.Fields
+}
+
+func (h *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fieldsHook) Fire(entry *logrus.Entry) error {
+	for k, v := range h.fields {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// logWriter logs every line written to it as an entry with the fields of
+// the output of a remote command. Close logs the last line if it isn't
+// terminated.
+type logWriter struct {
+	entry *logrus.Entry
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLogWriter(log *logrus.Entry, step, stream string) *logWriter {
+	return &logWriter{
+		entry: log.WithFields(logrus.Fields{"step": step, "stream": stream}),
+	}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.entry.Info(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.entry.Info(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
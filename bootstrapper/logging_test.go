@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs sends the logs to a buffer until the returned function is
+// called, which restores the logging configuration.
+func captureLogs() (*bytes.Buffer, func()) {
+	logger := logrus.StandardLogger()
+	formatter, level, hooks := logger.Formatter, logger.Level, logger.Hooks
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logger.Hooks = make(logrus.LevelHooks)
+	return &buf, func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(formatter)
+		logrus.SetLevel(level)
+		logger.Hooks = hooks
+		runID, remoteOutputLogs = "", false
+	}
+}
+
+// jsonLogs decodes the entries of JSON logs.
+func jsonLogs(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON log %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestConfigureLogging(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+
+	assert.Error(t, configureLogging("xml", "info", ""))
+	assert.Error(t, configureLogging(logFormatJSON, "chatty", ""))
+
+	assert.NoError(t, configureLogging(logFormatJSON, "warn", "nightly-42"))
+	logrus.Info("hidden")
+	logrus.WithField("stack", "docker-e2e-1").Warn("over budget")
+	entries := jsonLogs(t, buf)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "over budget", entries[0]["msg"])
+	assert.Equal(t, "warning", entries[0]["level"])
+	assert.Equal(t, "nightly-42", entries[0]["run_id"])
+	assert.Equal(t, "docker-e2e-1", entries[0]["stack"])
+	assert.Equal(t, "nightly-42", runID)
+	assert.True(t, remoteOutputLogs)
+
+	logrus.StandardLogger().Hooks = make(logrus.LevelHooks)
+	assert.NoError(t, configureLogging(logFormatText, "info", ""))
+	assert.Len(t, runID, 16, "a random run ID must be generated")
+	assert.False(t, remoteOutputLogs)
+}
+
+func TestLogWriter(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+
+	w := newLogWriter(logrus.NewEntry(logrus.StandardLogger()), "step-02", "stderr")
+	w.Write([]byte("first line\r\nsec"))
+	w.Write([]byte("ond line\nunterminated"))
+	w.Close()
+
+	entries := jsonLogs(t, buf)
+	messages := []string{}
+	for _, e := range entries {
+		messages = append(messages, e["msg"].(string))
+		assert.Equal(t, "step-02", e["step"])
+		assert.Equal(t, "stderr", e["stream"])
+	}
+	assert.Equal(t, []string{"first line", "second line", "unterminated"}, messages)
+}
+
+func TestRunStepJSONLogs(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	env, _ := newTestEnvironment(t, server)
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	buf, restore := captureLogs()
+	defer restore()
+	assert.NoError(t, configureLogging(logFormatJSON, "info", "nightly-42"))
+
+	_, err := runStep(env, &Config{}, nil, stepName(2), "echo out; echo err >&2", &Env{})
+	assert.NoError(t, err)
+
+	streams := map[string]string{}
+	for _, e := range jsonLogs(t, buf) {
+		assert.Equal(t, "nightly-42", e["run_id"])
+		assert.Equal(t, "step-03", e["step"])
+		streams[e["stream"].(string)] = e["msg"].(string)
+	}
+	assert.Equal(t, map[string]string{"stdout": "out", "stderr": "err"}, streams)
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"text/tabwriter"
 	"time"
 
-	"gopkg.in/yaml.v2"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/spf13/cobra"
 )
 
@@ -20,43 +24,255 @@ const (
 	region = "us-east-1"
 )
 
-type Config struct {
-	Environment *EnvironmentConfig `yaml:"environment,omitempty"`
+func runTests(c *Environment, cfg *Config) (results []*Result, err error) {
+	artifacts, err := NewArtifacts(cfg.Artifacts)
+	if err != nil {
+		return nil, err
+	}
+
+	log := cfg.logger()
+	quarantine, err := LoadQuarantine(cfg.Quarantine)
+	if err != nil {
+		return nil, err
+	}
+	if err := quarantine.Check(time.Now()); err != nil {
+		return nil, err
+	}
+
+	outputs, err := c.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	if err := outputs.write(artifacts); err != nil {
+		return nil, err
+	}
+
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+	defer c.Disconnect()
+
+	if err := uploadLocalTests(c, cfg); err != nil {
+		return nil, err
+	}
+	quarantineEnv, err := quarantine.upload(c, cfg.Quarantine)
+	if err != nil {
+		return nil, err
+	}
 
-	Commands []string `yaml:"commands,omitempty"`
+	// Undo the chaos actions once the commands are done.
+	monkey := newChaosMonkey(environmentCluster{c})
+	monkey.log = log
+	// Killing the leader may move the bootstrapper to another manager, which
+	// needs the files of the first one.
+	monkey.connected = func() error {
+		if err := uploadLocalTests(c, cfg); err != nil {
+			return err
+		}
+		_, err := quarantine.upload(c, cfg.Quarantine)
+		return err
+	}
+	defer func() {
+		if restoreErr := monkey.restore(nil); restoreErr != nil && err == nil {
+			err = restoreErr
+		}
+	}()
+
+	results = []*Result{}
+	for i, command := range cfg.Commands {
+		if command.Chaos != nil {
+			log.Infof("$ %s", command.Chaos)
+			result, err := runChaosStep(monkey, cfg, artifacts, stepName(i), command.Chaos)
+			if result != nil {
+				results = append(results, result)
+			}
+			if err != nil {
+				log.Errorf("==> \"%s\" failed: %s", command.Chaos, err)
+				return results, err
+			}
+			continue
+		}
+
+		cmd := command.Run
+		env, err := resolveEnv(outputs.Env(), quarantineEnv, cfg.Env, command.Env)
+		if err != nil {
+			return results, err
+		}
+		if len(env.Values()) > 0 {
+			log.Infof("$ %s %s", env, cmd)
+		} else {
+			log.Infof("$ %s", cmd)
+		}
+		result, err := runStep(c, cfg, artifacts, stepName(i), cmd, env)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil && result != nil && command.Retry != nil {
+			err = retryFailedTests(c, cfg, artifacts, i, command.Retry, result, env, err)
+		}
+		if result != nil {
+			err = quarantine.excuse(log, result, err)
+		}
+		if err != nil {
+			var duration time.Duration
+			if result != nil {
+				duration = result.Duration
+			}
+			log.Errorf("==> \"%s\" failed after %v: %s", cmd, duration, err)
+			return results, err
+		}
+		log.Infof("==> \"%s\" completed in %v", cmd, result.Duration)
+	}
+
+	return results, nil
+}
+
+// provisionEnvironment creates a new environment with a unique name.
+func provisionEnvironment(cf cloudformationiface.CloudFormationAPI, config *EnvironmentConfig) (*Environment, error) {
+	return NewNameAllocator(config.Naming).Provision(cf, config)
 }
 
-func loadConfig(path string) (*Config, error) {
-	data, err := ioutil.ReadFile(path)
+// runEnvironment provisions an environment, runs the config on it and
+// destroys it.
+func runEnvironment(cf cloudformationiface.CloudFormationAPI, name string, config *Config) *RunReport {
+	report := &RunReport{
+		Name:        name,
+		Environment: config.Environment,
+		Start:       time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.Start)
+	}()
+
+	provisionStart := time.Now()
+	env, err := provisionEnvironment(cf, config.Environment)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.StackID = env.id
+	report.Provisioning = time.Since(provisionStart)
+	if events, err := env.Events(); err != nil {
+		config.logger().Warnf("Unable to get the events of %s: %v", env.id, err)
+	} else {
+		report.Events = events
+	}
+
+	// Bring down the environment once we're done.
+	defer env.Destroy()
+
+	results, err := runTests(env, config)
+	report.Connect = env.connectDuration
+	report.addResults(results)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// runStep runs a command of the config, streaming its output to the console
+// and the artifacts directory, in files starting with name. With JSON logs,
+// the output is logged line by line, tagged with name and the stream.
+func runStep(c *Environment, cfg *Config, artifacts *Artifacts, name string, cmd string, env *Env) (*Result, error) {
+	stdoutLog, stderrLog, err := artifacts.Output(name)
 	if err != nil {
 		return nil, err
 	}
+	if stdoutLog != nil {
+		defer stdoutLog.Close()
+		defer stderrLog.Close()
+	}
+
+	var stdout, stderr []io.Writer
+	switch {
+	case cfg.Quiet:
+	case remoteOutputLogs:
+		stdoutEvents, stderrEvents := newLogWriter(cfg.logger(), name, "stdout"), newLogWriter(cfg.logger(), name, "stderr")
+		defer stdoutEvents.Close()
+		defer stderrEvents.Close()
+		stdout = append(stdout, stdoutEvents)
+		stderr = append(stderr, stderrEvents)
+	default:
+		stdout = append(stdout, os.Stdout)
+		stderr = append(stderr, os.Stderr)
+	}
+	if stdoutLog != nil {
+		stdout = append(stdout, stdoutLog)
+		stderr = append(stderr, stderrLog)
+	}
+	if cfg.output != nil {
+		fmt.Fprintf(cfg.output, "$ %s\n", cmd)
+		stdout = append(stdout, cfg.output)
+		stderr = append(stderr, cfg.output)
+	}
+
+	result, err := c.Run(cmd, env.Values(), multiWriter(stdout...), multiWriter(stderr...))
+	if stdoutLog != nil {
+		result.Logs = artifacts.Path(name)
+	}
+	return result, err
+}
+
+// multiWriter is like io.MultiWriter but returns nil for no writers.
+func multiWriter(writers ...io.Writer) io.Writer {
+	switch len(writers) {
+	case 0:
+		return nil
+	case 1:
+		return writers[0]
+	}
+	return io.MultiWriter(writers...)
+}
 
-	config := &Config{}
-	if err := yaml.Unmarshal(data, &config); err != nil {
+// addRunFlags registers the flags shared by commands running tests.
+func addRunFlags(cmd *cobra.Command) {
+	addConfigFlags(cmd)
+	cmd.Flags().String("artifacts", "", "Directory where command output is saved")
+	cmd.Flags().Bool("quiet", false, "Don't stream command output to the console")
+	cmd.Flags().Duration("budget-wait", 0, "How long to wait for the budget to allow a new stack")
+	cmd.Flags().String("quarantine", "", "File listing the tests whose failures are ignored")
+}
+
+// loadRunConfig loads the config at path, using the loading options and the
+// overrides set on the command line.
+func loadRunConfig(cmd *cobra.Command, path string) (*Config, error) {
+	opts, err := configOptions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyRunFlags(cmd, config); err != nil {
 		return nil, err
 	}
 	return config, nil
 }
 
-func runTests(c *Environment, cfg *Config) error {
-	if err := c.Connect(); err != nil {
-		return err
+// applyRunFlags overrides config values with flags set on the command line.
+func applyRunFlags(cmd *cobra.Command, config *Config) error {
+	if cmd.Flags().Changed("artifacts") {
+		artifacts, err := cmd.Flags().GetString("artifacts")
+		if err != nil {
+			return err
+		}
+		config.Artifacts = artifacts
 	}
-	defer c.Disconnect()
-
-	for _, cmd := range cfg.Commands {
-		logrus.Infof("$ %s", cmd)
-		now := time.Now()
-		err := c.Run(cmd)
-		duration := time.Since(now)
+	if cmd.Flags().Changed("quiet") {
+		quiet, err := cmd.Flags().GetBool("quiet")
 		if err != nil {
-			logrus.Errorf("==> \"%s\" failed after %v: %s", cmd, duration, err)
 			return err
 		}
-		logrus.Infof("==> \"%s\" completed in %v", cmd, duration)
+		config.Quiet = quiet
+	}
+	if cmd.Flags().Changed("quarantine") {
+		quarantine, err := cmd.Flags().GetString("quarantine")
+		if err != nil {
+			return err
+		}
+		config.Quarantine = quarantine
 	}
-
 	return nil
 }
 
@@ -67,23 +283,38 @@ var (
 
 			SSHKeyName: "swarm",
 
-			Managers: "3",
-			Workers:  "5",
+			Managers: 3,
+			Workers:  5,
 
 			InstanceType: "t2.micro",
 		},
 
-		Commands: []string{
-			"docker version",
-			"docker info",
-			"docker pull dockerswarm/e2e",
-			"docker run -v /var/run/docker.sock:/var/run/docker.sock --net=host dockerswarm/e2e",
+		Commands: []Command{
+			{Run: "docker version"},
+			{Run: "docker info"},
+			{Run: "docker pull dockerswarm/e2e"},
+			{Run: "docker run -v /var/run/docker.sock:/var/run/docker.sock --net=host dockerswarm/e2e"},
 		},
 	}
 
 	mainCmd = &cobra.Command{
 		Use:   os.Args[0],
 		Short: "Docker End to End Testing",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			format, err := cmd.Flags().GetString("log-format")
+			if err != nil {
+				return err
+			}
+			level, err := cmd.Flags().GetString("log-level")
+			if err != nil {
+				return err
+			}
+			id, err := cmd.Flags().GetString("run-id")
+			if err != nil {
+				return err
+			}
+			return configureLogging(format, level, id)
+		},
 	}
 
 	purgeCmd = &cobra.Command{
@@ -98,8 +329,11 @@ var (
 			if err != nil {
 				return err
 			}
-			Purge(sess(), ttlDelay)
-			return nil
+			prefix, err := cmd.Flags().GetString("prefix")
+			if err != nil {
+				return err
+			}
+			return purgeStacks(stateStore(cmd), prefix, ttlDelay)
 		},
 	}
 
@@ -111,35 +345,390 @@ var (
 				return errors.New("Config missing")
 			}
 
-			config, err := loadConfig(args[0])
+			config, err := loadRunConfig(cmd, args[0])
 			if err != nil {
 				return err
 			}
+			for _, entry := range config.Environments() {
+				if err := checkTemplate(entry.Environment.Template); err != nil {
+					return err
+				}
+			}
 
-			var (
-				env *Environment
-			)
-			for r := 0; r < 100; r++ {
-				t := time.Now()
-				name := fmt.Sprintf("docker-e2e-%d%02d%02d-%d", t.Year(), t.Month(), t.Day(), r)
-				env, err = Provision(sess(), name, config.Environment)
+			localTests, err := cmd.Flags().GetString("local-tests")
+			if err != nil {
+				return err
+			}
+			if localTests != "" {
+				pattern, err := cmd.Flags().GetString("run")
 				if err != nil {
-					// Try with another name.
-					if strings.Contains(err.Error(), "AlreadyExistsException") {
-						continue
+					return err
+				}
+				binary, cleanup, err := buildLocalTests(localTests)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				config = localTestsConfig(config, binary, pattern)
+			} else if cmd.Flags().Changed("run") {
+				return errors.New("--run can only be used with --local-tests")
+			}
+
+			fromPool, err := cmd.Flags().GetBool("from-pool")
+			if err != nil {
+				return err
+			}
+			if fromPool {
+				if config.Matrix != nil {
+					return errors.New("--from-pool can't be used with a matrix")
+				}
+				timeout, err := cmd.Flags().GetDuration("pool-timeout")
+				if err != nil {
+					return err
+				}
+				report := runFromPool(NewPool(cloudFormation(), stateStore(cmd), config), config, timeout)
+				finishRun(cmd, config, args[0], report)
+				if report.Failed() {
+					return errors.New(report.Error)
+				}
+				return nil
+			}
+
+			if config.Matrix != nil {
+				reports := runMatrix(provisioningCloudFormation(cmd, config), config)
+				finishRun(cmd, config, args[0], reports...)
+				failed, err := summarizeMatrix(config, reports)
+				if err != nil {
+					return err
+				}
+				if failed > 0 {
+					return fmt.Errorf("%d of %d matrix runs failed", failed, len(reports))
+				}
+				return nil
+			}
+
+			report := runEnvironment(provisioningCloudFormation(cmd, config), "", config)
+			finishRun(cmd, config, args[0], report)
+			if report.Failed() {
+				return errors.New(report.Error)
+			}
+
+			return nil
+		},
+	}
+
+	validateCmd = &cobra.Command{
+		Use:   "validate <config>...",
+		Short: "Check configs without provisioning anything",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("Config missing")
+			}
+			opts, err := configOptions(cmd)
+			if err != nil {
+				return err
+			}
+			offline, err := cmd.Flags().GetBool("offline")
+			if err != nil {
+				return err
+			}
+
+			invalid := 0
+			for _, path := range args {
+				config, err := loadConfig(path, opts)
+				if err == nil && !offline {
+					templates := []string{}
+					for _, entry := range config.Environments() {
+						templates = append(templates, entry.Environment.Template)
 					}
+					if config.Upgrade != nil {
+						templates = append(templates, config.Upgrade.Template)
+					}
+					for _, template := range templates {
+						if err = checkTemplate(template); err != nil {
+							break
+						}
+					}
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					invalid++
+					continue
+				}
+				logrus.Infof("%s: OK", path)
+			}
+			if invalid > 0 {
+				return fmt.Errorf("%d of %d configs are invalid", invalid, len(args))
+			}
+			return nil
+		},
+	}
+
+	upgradeCmd = &cobra.Command{
+		Use:   "upgrade <config>",
+		Short: "Provision a test environment and upgrade it in place",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("Config missing")
+			}
+
+			config, err := loadRunConfig(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			if config.Upgrade == nil {
+				return errors.New("Config has no upgrade section")
+			}
+			for _, template := range []string{config.Environment.Template, config.Upgrade.Template} {
+				if err := checkTemplate(template); err != nil {
 					return err
 				}
-				break
 			}
 
-			// Bring down the environment once we're done.
-			defer env.Destroy()
+			report := runUpgrade(provisioningCloudFormation(cmd, config), config)
+			recordHistory(cmd, args[0], report)
+			saveHTMLReport(config, report)
+			if report.Failed() {
+				return errors.New(report.Error)
+			}
+
+			return nil
+		},
+	}
+
+	bisectCmd = &cobra.Command{
+		Use:   "bisect <config>",
+		Short: "Find the first template version failing the tests",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("Config missing")
+			}
+			config, err := loadRunConfig(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			if config.Matrix != nil {
+				return errors.New("bisect can't be used with a matrix")
+			}
 
-			if err := runTests(env, config); err != nil {
+			good, err := cmd.Flags().GetString("good")
+			if err != nil {
+				return err
+			}
+			bad, err := cmd.Flags().GetString("bad")
+			if err != nil {
+				return err
+			}
+			list, err := cmd.Flags().GetString("list")
+			if err != nil {
+				return err
+			}
+			if good == "" || bad == "" || list == "" {
+				return errors.New("--good, --bad and --list are required")
+			}
+			pattern, err := cmd.Flags().GetString("run")
+			if err != nil {
+				return err
+			}
+			noCache, err := cmd.Flags().GetBool("no-cache")
+			if err != nil {
+				return err
+			}
+			templates, err := loadTemplateList(list)
+			if err != nil {
 				return err
 			}
 
+			cf := provisioningCloudFormation(cmd, config)
+			probe := func(template string) (string, error) {
+				if !noCache {
+					history, err := OpenHistory(historyPath(cmd))
+					if err != nil {
+						return "", err
+					}
+					verdict, err := cachedVerdict(history, args[0], template, pattern)
+					history.Close()
+					if err != nil {
+						return "", err
+					}
+					if verdict != "" {
+						logrus.Infof("==> Using the result of a previous run of %s", template)
+						return verdict, nil
+					}
+				}
+
+				i := 0
+				for i < len(templates) && templates[i] != template {
+					i++
+				}
+				report := runEnvironment(cf, bisectRunName(i), bisectConfig(config, i, template, pattern))
+				report.TestRun = pattern
+				recordHistory(cmd, args[0], report)
+				if report.Failed() {
+					logrus.Warnf("%s: %s", template, report.Error)
+				}
+				return bisectVerdict(report, pattern), nil
+			}
+
+			first, err := bisect(templates, good, bad, probe)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s is the first bad template\n", first)
+			return nil
+		},
+	}
+
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Run configs on behalf of HTTP clients and schedules",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listen, err := cmd.Flags().GetString("listen")
+			if err != nil {
+				return err
+			}
+			concurrency, err := cmd.Flags().GetInt("concurrency")
+			if err != nil {
+				return err
+			}
+			queueSize, err := cmd.Flags().GetInt("queue")
+			if err != nil {
+				return err
+			}
+			if concurrency < 1 || queueSize < 1 {
+				return errors.New("--concurrency and --queue must be at least 1")
+			}
+			tokenFile, err := cmd.Flags().GetString("token-file")
+			if err != nil {
+				return err
+			}
+
+			server := &Server{
+				History: historyPath(cmd),
+				CloudFormation: func(config *Config) cloudformationiface.CloudFormationAPI {
+					return provisioningCloudFormation(cmd, config)
+				},
+			}
+			if server.Configs, err = cmd.Flags().GetString("configs"); err != nil {
+				return err
+			}
+			if server.Artifacts, err = cmd.Flags().GetString("artifacts"); err != nil {
+				return err
+			}
+			if tokenFile != "" {
+				token, err := EnvValue{FromFile: tokenFile}.Resolve()
+				if err != nil {
+					return err
+				}
+				server.Token = token
+			} else if listen != "" && !isLoopback(listen) {
+				return fmt.Errorf("--token-file is required to listen on %s", listen)
+			}
+
+			var scheduler *Scheduler
+			if path, err := cmd.Flags().GetString("schedules"); err != nil {
+				return err
+			} else if path != "" {
+				schedules, err := LoadSchedules(path)
+				if err != nil {
+					return err
+				}
+				for _, s := range schedules {
+					if s.Config == "" {
+						continue
+					}
+					if _, err := server.loadConfig(s.request()); err != nil {
+						return fmt.Errorf("schedule %s: %v", s.Name, err)
+					}
+				}
+				store := stateStore(cmd)
+				scheduler = &Scheduler{
+					Schedules: schedules,
+					Server:    server,
+					Store:     store,
+					Purge: func(prefix string, ttl time.Duration) error {
+						return purgeStacks(store, prefix, ttl)
+					},
+				}
+			}
+			if listen == "" && scheduler == nil {
+				return errors.New("nothing to serve without --listen nor --schedules")
+			}
+
+			server.Start(concurrency, queueSize)
+			if listen == "" {
+				logrus.Infof("Running %d schedules", len(scheduler.Schedules))
+				scheduler.Run(nil)
+				return nil
+			}
+			if scheduler != nil {
+				logrus.Infof("Running %d schedules", len(scheduler.Schedules))
+				go scheduler.Run(nil)
+			}
+			logrus.Infof("Serving configs of %s on %s", server.Configs, listen)
+			return http.ListenAndServe(listen, server)
+		},
+	}
+
+	poolCmd = &cobra.Command{
+		Use:   "pool",
+		Short: "Manage warm environment pools",
+	}
+
+	poolMaintainCmd = &cobra.Command{
+		Use:   "maintain <config>",
+		Short: "Keep the pool of a config filled",
+		Long: `Keep the pool of a config filled, until interrupted.
+
+Runs destroying their environment after a failure provision a replacement
+before exiting, but environments whose holder died are only replaced by this
+command: it must run continuously for "run --from-pool" not to wait for an
+environment.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pool, err := poolFromArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			interval, err := cmd.Flags().GetDuration("interval")
+			if err != nil {
+				return err
+			}
+			pool.Maintain(interval, nil)
+			return nil
+		},
+	}
+
+	poolDrainCmd = &cobra.Command{
+		Use:   "drain <config>",
+		Short: "Destroy the idle environments of the pool of a config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pool, err := poolFromArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			return pool.Drain()
+		},
+	}
+
+	poolStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "List the environments of all pools",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, err := stateStore(cmd).Load()
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			for _, s := range state.Pool {
+				status := "ready"
+				if s.Lease != nil {
+					status = fmt.Sprintf("leased by %s", s.Lease.Holder)
+					if s.Lease.expired(now) {
+						status += " (expired)"
+					}
+				}
+				fmt.Printf("%s\t%s\t%v\t%s\n", s.Key, s.StackID, now.Sub(s.Created)-now.Sub(s.Created)%time.Second, status)
+			}
 			return nil
 		},
 	}
@@ -152,22 +741,305 @@ var (
 				return errors.New("Config or AWS Stack ID missing")
 			}
 
-			config, err := loadConfig(args[0])
+			config, err := loadRunConfig(cmd, args[0])
 			if err != nil {
 				return err
 			}
 
-			env := NewEnvironment(args[1], sess())
+			env := NewEnvironment(args[1], cloudFormation(), config.Environment)
+			report := &RunReport{
+				StackID:     args[1],
+				Environment: config.Environment,
+				Start:       time.Now(),
+			}
+			results, err := runTests(env, config)
+			report.Connect = env.connectDuration
+			report.addResults(results)
+			report.Duration = time.Since(report.Start)
+			if err != nil {
+				report.Error = err.Error()
+			}
+			recordHistory(cmd, args[0], report)
+			saveHTMLReport(config, report)
+
+			return err
+		},
+	}
+
+	historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "List past runs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filter := HistoryFilter{}
+			var err error
+			if filter.Template, err = cmd.Flags().GetString("template"); err != nil {
+				return err
+			}
+			if filter.Test, err = cmd.Flags().GetString("test"); err != nil {
+				return err
+			}
+			if filter.Failed, err = cmd.Flags().GetBool("failed"); err != nil {
+				return err
+			}
+			if filter.Limit, err = cmd.Flags().GetInt("limit"); err != nil {
+				return err
+			}
+			since, err := cmd.Flags().GetDuration("since")
+			if err != nil {
+				return err
+			}
+			if since > 0 {
+				filter.Since = time.Now().Add(-since)
+			}
 
-			if err := runTests(env, config); err != nil {
+			history, err := OpenHistory(historyPath(cmd))
+			if err != nil {
+				return err
+			}
+			defer history.Close()
+			records, err := history.List(filter)
+			if err != nil {
 				return err
 			}
 
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			header := "ID\tSTARTED\tCOMMAND\tTEMPLATE\tDURATION\tRESULT"
+			if filter.Test != "" {
+				header += "\t" + filter.Test
+			}
+			fmt.Fprintln(w, header)
+			for _, r := range records {
+				result := "ok"
+				if r.Failed() {
+					result = "FAIL"
+				}
+				line := fmt.Sprintf("%d\t%s\t%s\t%s\t%v\t%s", r.ID, r.Start.Format("2006-01-02 15:04"), r.Command, r.Template(), r.Duration-r.Duration%time.Second, result)
+				if filter.Test != "" {
+					line += "\t" + r.TestStatus(filter.Test)
+					if r.testFlaky(filter.Test) {
+						line += " (flaky)"
+					}
+				}
+				fmt.Fprintln(w, line)
+			}
+			return w.Flush()
+		},
+	}
+
+	historyShowCmd = &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show the details of a run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			records, err := historyRecords(cmd, args, 1)
+			if err != nil {
+				return err
+			}
+			data, err := json.MarshalIndent(records[0], "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
 			return nil
 		},
 	}
+
+	historyFlakyCmd = &cobra.Command{
+		Use:   "flaky",
+		Short: "List the tests which passed on retry, the flakiest first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filter := HistoryFilter{}
+			var err error
+			if filter.Template, err = cmd.Flags().GetString("template"); err != nil {
+				return err
+			}
+			since, err := cmd.Flags().GetDuration("since")
+			if err != nil {
+				return err
+			}
+			if since > 0 {
+				filter.Since = time.Now().Add(-since)
+			}
+
+			history, err := OpenHistory(historyPath(cmd))
+			if err != nil {
+				return err
+			}
+			defer history.Close()
+			records, err := history.List(filter)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TEST\tRUNS\tFLAKY\tSCORE")
+			for _, f := range flakiness(records) {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\n", f.Name, f.Runs, f.Flaky, f.Score())
+			}
+			return w.Flush()
+		},
+	}
+
+	historyDiffCmd = &cobra.Command{
+		Use:   "diff <id> <id>",
+		Short: "Show the tests whose result changed between two runs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			records, err := historyRecords(cmd, args, 2)
+			if err != nil {
+				return err
+			}
+			before, after := records[0], records[1]
+			fmt.Printf("%d: %s (%s)\n", before.ID, before.Template(), before.Start.Format("2006-01-02 15:04"))
+			fmt.Printf("%d: %s (%s)\n", after.ID, after.Template(), after.Start.Format("2006-01-02 15:04"))
+
+			changes := diffRuns(before, after)
+			if len(changes) == 0 {
+				fmt.Println("No test changed")
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "TEST\t%d\t%d\n", before.ID, after.ID)
+			for _, c := range changes {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, orNone(c.Before), orNone(c.After))
+			}
+			return w.Flush()
+		},
+	}
 )
 
+// poolFromArgs returns the pool of the config passed as argument.
+func poolFromArgs(cmd *cobra.Command, args []string) (*Pool, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Config missing")
+	}
+	opts, err := configOptions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(args[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewPool(provisioningCloudFormation(cmd, config), stateStore(cmd), config), nil
+}
+
+// finishRun records the reports of the run command in the history, posts
+// their summary and exports their metrics.
+func finishRun(cmd *cobra.Command, config *Config, path string, reports ...*RunReport) {
+	recordHistory(cmd, path, reports...)
+	saveHTMLReport(config, reports...)
+	notifyRun(config, path, reports...)
+	exportMetrics(config.Metrics, path, reports...)
+}
+
+// purgeStacks deletes the stacks named with prefix older than ttl, except
+// those of the pools.
+func purgeStacks(store *StateStore, prefix string, ttl time.Duration) error {
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+	pooled := make(map[string]bool)
+	for _, s := range state.Pool {
+		pooled[s.StackID] = true
+	}
+	return Purge(cloudFormation(), prefix, ttl, pooled)
+}
+
+// recordHistory saves the reports of a command in the history, under the ID
+// of the invocation. Failing to do so doesn't fail the command.
+func recordHistory(cmd *cobra.Command, config string, reports ...*RunReport) {
+	saveHistory(historyPath(cmd), cmd.Name(), config, runID, reports...)
+}
+
+// saveHistory saves the reports of a run of config by command in the history
+// at path.
+func saveHistory(path, command, config, runID string, reports ...*RunReport) {
+	history, err := OpenHistory(path)
+	if err != nil {
+		logrus.Errorf("Unable to record the run in the history: %v", err)
+		return
+	}
+	defer history.Close()
+
+	for _, report := range reports {
+		err := history.Add(&HistoryRecord{
+			Command:   command,
+			Config:    config,
+			RunID:     runID,
+			RunReport: report,
+		})
+		if err != nil {
+			logrus.Errorf("Unable to record the run in the history: %v", err)
+		}
+	}
+}
+
+// historyRecords returns the runs whose IDs are the n arguments.
+func historyRecords(cmd *cobra.Command, args []string, n int) ([]*HistoryRecord, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%d run IDs expected", n)
+	}
+	history, err := OpenHistory(historyPath(cmd))
+	if err != nil {
+		return nil, err
+	}
+	defer history.Close()
+
+	records := []*HistoryRecord{}
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid run ID %q", arg)
+		}
+		record, err := history.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func orNone(status string) string {
+	if status == "" {
+		return "-"
+	}
+	return status
+}
+
+func historyPath(cmd *cobra.Command) string {
+	path, err := cmd.Flags().GetString("history")
+	if err != nil || path == "" {
+		path = defaultHistoryPath()
+	}
+	return path
+}
+
+func stateStore(cmd *cobra.Command) *StateStore {
+	path, err := cmd.Flags().GetString("state")
+	if err != nil || path == "" {
+		path = defaultStatePath()
+	}
+	return NewStateStore(path)
+}
+
+func cloudFormation() cloudformationiface.CloudFormationAPI {
+	return cloudformation.New(sess())
+}
+
+// provisioningCloudFormation returns the client of commands creating stacks,
+// which enforces the budget of config if any.
+func provisioningCloudFormation(cmd *cobra.Command, config *Config) cloudformationiface.CloudFormationAPI {
+	if config.Budget == nil {
+		return cloudFormation()
+	}
+	// Commands without the flag never wait.
+	wait, _ := cmd.Flags().GetDuration("budget-wait")
+	cf := withBudget(cloudFormation(), ec2.New(sess()), stateStore(cmd), config.Budget, wait)
+	cf.(*budgetCloudFormation).log = config.logger()
+	return cf
+}
+
 func sess() *session.Session {
 	s, err := session.NewSession(aws.NewConfig().WithRegion(region))
 	if err != nil {
@@ -177,11 +1049,68 @@ func sess() *session.Session {
 }
 
 func init() {
+	mainCmd.PersistentFlags().String("state", "", "Path of the state file (default ~/.docker-e2e/state.json)")
+	mainCmd.PersistentFlags().String("history", "", "Path of the run history (default ~/.docker-e2e/history.db)")
+	mainCmd.PersistentFlags().String("log-format", logFormatText, "Format of the logs, text or json")
+	mainCmd.PersistentFlags().String("log-level", "info", "Minimum level of the logs (debug, info, warn, error)")
+	mainCmd.PersistentFlags().String("run-id", "", "ID of the run in the logs and the history (default random)")
+
 	purgeCmd.Flags().String("ttl", "1h", "Delete environments older than this")
+	purgeCmd.Flags().String("prefix", defaultStackPrefix, "Only delete stacks named with this prefix")
+	addRunFlags(runCmd)
+	addRunFlags(testCmd)
+	addRunFlags(upgradeCmd)
+	addRunFlags(bisectCmd)
+	bisectCmd.Flags().String("good", "", "Template known to pass the tests")
+	bisectCmd.Flags().String("bad", "", "Template known to fail the tests")
+	bisectCmd.Flags().String("list", "", "File listing the templates to search, one per line from the oldest")
+	bisectCmd.Flags().String("run", "", "Only run the tests matching this, as go test -run")
+	bisectCmd.Flags().Bool("no-cache", false, "Test templates again even if the history has their result")
+	runCmd.Flags().Bool("from-pool", false, "Use an environment of the pool instead of provisioning one, and provision its replacement if the run fails")
+	runCmd.Flags().Duration("pool-timeout", 30*time.Minute, "How long to wait for a pool environment")
+	runCmd.Flags().String("local-tests", "", "Build the tests package in this directory and run it instead of the tests command")
+	runCmd.Flags().String("run", "", "Only run the local tests matching this pattern")
+	addConfigFlags(validateCmd)
+	addConfigFlags(poolMaintainCmd)
+	addConfigFlags(poolDrainCmd)
+	serveCmd.Flags().String("listen", "127.0.0.1:8080", "Address to listen on, other than localhost only with --token-file")
+	serveCmd.Flags().String("configs", ".", "Directory of the configs clients may run")
+	serveCmd.Flags().String("artifacts", "", "Directory where the output of each job is saved")
+	serveCmd.Flags().String("schedules", "", "File of the schedules to run, --listen may be empty to only run them")
+	serveCmd.Flags().String("token-file", "", "File holding the bearer token clients must present")
+	serveCmd.Flags().Int("concurrency", 1, "Maximum number of jobs run at the same time")
+	serveCmd.Flags().Int("queue", 20, "Maximum number of queued jobs")
+	serveCmd.Flags().Duration("budget-wait", 0, "How long to wait for the budget to allow a new stack")
+	poolMaintainCmd.Flags().Duration("interval", time.Minute, "How often to check the pool")
+	historyCmd.Flags().String("template", "", "Only list runs whose template contains this")
+	historyCmd.Flags().String("test", "", "Only list runs of this test, with its result")
+	historyCmd.Flags().Bool("failed", false, "Only list failed runs")
+	historyCmd.Flags().Duration("since", 0, "Only list runs started in this period")
+	historyCmd.Flags().Int("limit", 20, "Maximum number of runs listed, 0 for all")
+	historyFlakyCmd.Flags().String("template", "", "Only count runs whose template contains this")
+	historyFlakyCmd.Flags().Duration("since", 7*24*time.Hour, "Only count runs started in this period")
 
+	poolCmd.AddCommand(
+		poolMaintainCmd,
+		poolDrainCmd,
+		poolStatusCmd,
+	)
+	validateCmd.Flags().Bool("offline", false, "Don't check that the template can be fetched")
+
+	historyCmd.AddCommand(
+		historyShowCmd,
+		historyDiffCmd,
+		historyFlakyCmd,
+	)
 	mainCmd.AddCommand(
 		runCmd,
 		testCmd,
+		upgradeCmd,
+		bisectCmd,
+		serveCmd,
+		validateCmd,
+		poolCmd,
+		historyCmd,
 		purgeCmd,
 	)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestRunEnvironmentProvisionFailure(t *testing.T) {
+	defer fixedSuffixes("a1b2c3")()
+	cf := newFakeCloudFormation()
+	config := testEnvironmentConfig()
+	config.Naming = &Naming{Owner: "ci"}
+	cf.FailCreate[NewNameAllocator(config.Naming).Name()] = true
+
+	report := runEnvironment(cf, "", &Config{
+		Environment: config,
+		Commands:    []Command{{Run: "docker version"}},
+	})
+	assert.True(t, report.Failed())
+	assert.Empty(t, report.Steps)
+}
+
+func TestRunEnvironment(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+
+	artifacts, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(artifacts)
+
+	report := runEnvironment(cf, "", &Config{
+		Environment: server.environmentConfig(),
+		Env:         map[string]EnvValue{"SUITE": {Value: "smoke"}},
+		Commands: []Command{
+			{Run: "echo $SUITE"},
+			{Run: "echo failure >&2"},
+		},
+		Artifacts: artifacts,
+		Quiet:     true,
+	})
+	assert.False(t, report.Failed(), report.Error)
+	assert.Len(t, report.Steps, 2)
+	assert.True(t, report.Provisioning > 0)
+	assert.True(t, report.Connect > 0)
+	assert.NotEmpty(t, report.Events)
+	assert.Equal(t, []string{
+		"export SUITE='smoke'; echo $SUITE",
+		"export SUITE='smoke'; echo failure >&2",
+	}, server.Received())
+
+	stdout, err := ioutil.ReadFile(filepath.Join(artifacts, "step-01.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "smoke\n", string(stdout))
+	stderr, err := ioutil.ReadFile(filepath.Join(artifacts, "step-02.stderr.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "failure\n", string(stderr))
+
+	assert.Equal(t, cloudformation.StackStatusDeleteComplete, aws.StringValue(cf.Stack(report.StackID).StackStatus))
+}
+
+func TestRunEnvironmentStepFailure(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+	server.ExitCodes["docker run dockerswarm/e2e"] = 3
+
+	report := runEnvironment(cf, "", &Config{
+		Environment: server.environmentConfig(),
+		Commands: []Command{
+			{Run: "docker run dockerswarm/e2e"},
+			{Run: "docker service ls"},
+		},
+		Quiet: true,
+	})
+	assert.True(t, report.Failed())
+	assert.Len(t, report.Steps, 1)
+	assert.Equal(t, 3, report.Steps[0].ExitStatus)
+	assert.Equal(t, []string{"docker run dockerswarm/e2e"}, server.Received(), "must stop at the first failure")
+	assert.Equal(t, cloudformation.StackStatusDeleteComplete, aws.StringValue(cf.Stack(report.StackID).StackStatus), "must destroy failed environments")
+}
+
+func TestRunEnvironmentOutputs(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	server.AcceptEnv = true
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{
+			"SSH":              server.sshOutput(),
+			"DefaultDNSTarget": name + "-ELB.us-east-1.elb.amazonaws.com",
+		}
+	}
+
+	artifacts, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(artifacts)
+
+	report := runEnvironment(cf, "", &Config{
+		Environment: server.environmentConfig(),
+		Commands: []Command{
+			{Run: "echo $DOCKER_E2E_ENDPOINT"},
+			{Run: "echo $DOCKER_E2E_ENDPOINT", Env: map[string]EnvValue{"DOCKER_E2E_ENDPOINT": {Value: "10.0.0.1"}}},
+		},
+		Artifacts: artifacts,
+		Quiet:     true,
+	})
+	assert.False(t, report.Failed(), report.Error)
+	name := *cf.Stack(report.StackID).StackName
+
+	stdout, err := ioutil.ReadFile(filepath.Join(artifacts, "step-01.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, name+"-ELB.us-east-1.elb.amazonaws.com\n", string(stdout))
+	stdout, err = ioutil.ReadFile(filepath.Join(artifacts, "step-02.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1\n", string(stdout), "config must take precedence")
+
+	for _, file := range []string{"outputs.json", "outputs.env"} {
+		_, err := os.Stat(filepath.Join(artifacts, file))
+		assert.NoError(t, err, file)
+	}
+}
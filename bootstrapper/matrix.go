@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// Matrix expands a config into one run per combination of the listed values.
+// Values that are not listed are taken from the environment section.
+//
+//	matrix:
+//	  concurrency: 2
+//	  templates:
+//	    - https://docker-for-aws.s3.amazonaws.com/aws/beta/latest.json
+//	    - https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json
+//	  managers: [1, 3, 5]
+type Matrix struct {
+	Templates     []string `yaml:"templates,omitempty"`
+	Managers      []int    `yaml:"managers,omitempty"`
+	Workers       []int    `yaml:"workers,omitempty"`
+	InstanceTypes []string `yaml:"instance_types,omitempty"`
+
+	// Concurrency is the maximum number of environments provisioned at the
+	// same time. Defaults to 1.
+	Concurrency int `yaml:"concurrency,omitempty"`
+}
+
+// MatrixEntry is a single combination of a matrix.
+type MatrixEntry struct {
+	Name        string
+	Environment *EnvironmentConfig
+}
+
+// Expand returns every combination of the matrix, applied on top of base.
+func (m *Matrix) Expand(base *EnvironmentConfig) []MatrixEntry {
+	if base == nil {
+		base = &EnvironmentConfig{}
+	}
+
+	templates := m.Templates
+	if len(templates) == 0 {
+		templates = []string{base.Template}
+	}
+	managers := m.Managers
+	if len(managers) == 0 {
+		managers = []int{base.Managers}
+	}
+	workers := m.Workers
+	if len(workers) == 0 {
+		workers = []int{base.Workers}
+	}
+	instanceTypes := m.InstanceTypes
+	if len(instanceTypes) == 0 {
+		instanceTypes = []string{base.InstanceType}
+	}
+
+	entries := []MatrixEntry{}
+	for t, template := range templates {
+		for _, manager := range managers {
+			for _, worker := range workers {
+				for _, instanceType := range instanceTypes {
+					env := *base
+					env.Template = template
+					env.Managers = manager
+					env.Workers = worker
+					env.InstanceType = instanceType
+					entries = append(entries, MatrixEntry{
+						Name:        fmt.Sprintf("template%d-m%d-w%d-%s", t, manager, worker, instanceType),
+						Environment: &env,
+					})
+				}
+			}
+		}
+	}
+	return entries
+}
+
+// Environments returns the environments the config runs on: one per matrix
+// entry, or just the environment section if there is no matrix.
+func (c *Config) Environments() []MatrixEntry {
+	if c.Matrix == nil {
+		return []MatrixEntry{{Environment: c.Environment}}
+	}
+	return c.Matrix.Expand(c.Environment)
+}
+
+// runMatrix runs the config on every combination of its matrix and returns
+// one report per combination, in order.
+func runMatrix(cf cloudformationiface.CloudFormationAPI, config *Config) []*RunReport {
+	entries := config.Matrix.Expand(config.Environment)
+	concurrency := config.Matrix.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	log := config.logger()
+	log.Infof("Running %d matrix entries, %d at a time", len(entries), concurrency)
+
+	reports := make([]*RunReport, len(entries))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry MatrixEntry) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			entryConfig := *config
+			entryConfig.Matrix = nil
+			entryConfig.Environment = entry.Environment
+			if config.Artifacts != "" {
+				entryConfig.Artifacts = filepath.Join(config.Artifacts, entry.Name)
+			}
+			// Output of concurrent runs would be interleaved on the console.
+			if concurrency > 1 {
+				entryConfig.Quiet = true
+			}
+
+			log.Infof("[%s] starting", entry.Name)
+			reports[i] = runEnvironment(cf, entry.Name, &entryConfig)
+			if reports[i].Failed() {
+				log.Errorf("[%s] failed after %v: %s", entry.Name, reports[i].Duration, reports[i].Error)
+			} else {
+				log.Infof("[%s] succeeded in %v", entry.Name, reports[i].Duration)
+			}
+		}(i, entry)
+	}
+	wg.Wait()
+
+	return reports
+}
+
+// summarizeMatrix logs the outcome of every entry and saves the combined
+// report in the artifacts directory. It returns the number of failed runs.
+func summarizeMatrix(config *Config, reports []*RunReport) (int, error) {
+	failed := 0
+	logrus.Info("Matrix summary:")
+	for _, r := range reports {
+		status := "PASS"
+		if r.Failed() {
+			status = "FAIL"
+			failed++
+		}
+		logrus.Infof("  %s %-40s %-12v %s", status, r.Name, r.Duration-r.Duration%time.Second, r.StackID)
+	}
+
+	artifacts, err := NewArtifacts(config.Artifacts)
+	if err != nil || artifacts == nil {
+		return failed, err
+	}
+	return failed, writeJSON(artifacts.Path("matrix.json"), reports)
+}
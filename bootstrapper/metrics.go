@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// defaultMetricsJob is the job the metrics are pushed as.
+const defaultMetricsJob = "docker_e2e"
+
+// MetricsConfig exports the timings of runs as Prometheus metrics, to a
+// pushgateway or as a file for the textfile collector of node_exporter.
+//
+//	metrics:
+//	  pushgateway: http://pushgateway.example.com:9091
+//	  textfile: /var/lib/node_exporter/docker_e2e.prom
+type MetricsConfig struct {
+	// Pushgateway is the URL of the pushgateway the metrics are pushed to
+	// at the end of runs.
+	Pushgateway string `yaml:"pushgateway,omitempty"`
+	// Job is the job label of the pushed metrics, defaults to docker_e2e.
+	Job string `yaml:"job,omitempty"`
+	// Textfile is the path of a file the metrics are written to.
+	Textfile string `yaml:"textfile,omitempty"`
+}
+
+func (c *MetricsConfig) problems() []string {
+	problems := []string{}
+	if c == nil {
+		return problems
+	}
+	if c.Pushgateway == "" && c.Textfile == "" {
+		problems = append(problems, "metrics: one of pushgateway and textfile must be set")
+	}
+	if c.Pushgateway != "" {
+		if u, err := url.Parse(c.Pushgateway); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("metrics.pushgateway: invalid URL %q", c.Pushgateway))
+		}
+	}
+	if c.Textfile != "" && filepath.Ext(c.Textfile) != ".prom" {
+		// The textfile collector ignores other files.
+		problems = append(problems, "metrics.textfile: must end with .prom")
+	}
+	return problems
+}
+
+// metricFamily is a metric and its samples, keyed by their formatted labels.
+type metricFamily struct {
+	name    string
+	help    string
+	samples map[string]float64
+}
+
+// Metrics is a set of gauges, formatted in the Prometheus text format.
+type Metrics struct {
+	families map[string]*metricFamily
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// set sets the value of a gauge for labels, replacing any previous value.
+func (m *Metrics) set(name, help string, labels map[string]string, value float64) {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, samples: make(map[string]float64)}
+		m.families[name] = f
+	}
+	f.samples[formatLabels(labels)] = value
+}
+
+// Bytes formats the metrics in the Prometheus text format, sorted so that
+// the output is stable.
+func (m *Metrics) Bytes() []byte {
+	names := []string{}
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", f.name)
+		lines := []string{}
+		for labels, value := range f.samples {
+			lines = append(lines, fmt.Sprintf("%s%s %s", f.name, labels, strconv.FormatFloat(value, 'g', -1, 64)))
+		}
+		sort.Strings(lines)
+		for _, line := range lines {
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// formatLabels returns labels as {name="value",...}, sorted by name.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// runMetrics returns the timings of the reports of a run. Every metric is
+// labelled with the environment of its run, so that runs of a matrix can be
+// told apart.
+func runMetrics(reports ...*RunReport) *Metrics {
+	m := newMetrics()
+	for _, r := range reports {
+		labels := environmentLabels(r.Environment)
+		with := func(extra map[string]string) map[string]string {
+			l := map[string]string{}
+			for k, v := range labels {
+				l[k] = v
+			}
+			for k, v := range extra {
+				l[k] = v
+			}
+			return l
+		}
+
+		success := 1.0
+		if r.Failed() {
+			success = 0
+		}
+		m.set("docker_e2e_run_success", "Whether the last run passed.", labels, success)
+		m.set("docker_e2e_run_start_timestamp_seconds", "When the last run started.", labels, float64(r.Start.Unix()))
+		m.set("docker_e2e_run_duration_seconds", "How long the last run took.", labels, r.Duration.Seconds())
+		if r.Provisioning > 0 {
+			m.set("docker_e2e_provision_duration_seconds", "How long the stack took to be created.", labels, r.Provisioning.Seconds())
+		}
+		if r.Connect > 0 {
+			m.set("docker_e2e_ssh_connect_duration_seconds", "How long the SSH connection to the manager took.", labels, r.Connect.Seconds())
+		}
+		for i, step := range r.Steps {
+			m.set("docker_e2e_command_duration_seconds", "How long a command of the last run took.",
+				with(map[string]string{"step": stepName(i)}), step.Duration.Seconds())
+			for _, t := range step.Tests {
+				m.set("docker_e2e_test_duration_seconds", "How long a test of the last run took.",
+					with(map[string]string{"test": t.Name}), t.Duration.Seconds())
+			}
+		}
+	}
+	return m
+}
+
+// environmentLabels returns the labels identifying an environment.
+func environmentLabels(config *EnvironmentConfig) map[string]string {
+	if config == nil {
+		return map[string]string{}
+	}
+	return map[string]string{
+		"template":      config.Template,
+		"instance_type": config.InstanceType,
+		"managers":      strconv.Itoa(config.Managers),
+		"workers":       strconv.Itoa(config.Workers),
+	}
+}
+
+// exportMetrics exports the metrics of the reports of a run of the config at
+// path as configured. Failing to do so doesn't fail the run.
+func exportMetrics(config *MetricsConfig, path string, reports ...*RunReport) {
+	if config == nil {
+		return
+	}
+	if config.Textfile != "" {
+		if err := writeTextfile(config.Textfile, runMetrics(reports...)); err != nil {
+			logrus.Errorf("Unable to write metrics: %v", err)
+		}
+	}
+	if config.Pushgateway != "" {
+		job := config.Job
+		if job == "" {
+			job = defaultMetricsJob
+		}
+		// Each run has its own group, so that the runs of other configs or
+		// matrix entries don't replace its metrics.
+		for _, r := range reports {
+			group := [][2]string{{"job", job}, {"config", path}}
+			if r.Name != "" {
+				group = append(group, [2]string{"run", r.Name})
+			}
+			if err := pushMetrics(config.Pushgateway, group, runMetrics(r)); err != nil {
+				logrus.Errorf("Unable to push metrics: %v", err)
+			}
+		}
+	}
+}
+
+// writeTextfile writes metrics to path atomically, so that the collector
+// never reads a partial file.
+func writeTextfile(path string, metrics *Metrics) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(metrics.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushMetrics replaces the metrics of a group in the pushgateway. The group
+// is a list of label names and values, starting with the job.
+func pushMetrics(pushgateway string, group [][2]string, metrics *Metrics) error {
+	target := strings.TrimSuffix(pushgateway, "/") + "/metrics"
+	for _, label := range group {
+		name, value := label[0], label[1]
+		// Values which aren't plain path segments, such as the paths of
+		// configs, are base64 encoded as the pushgateway expects. "=" is
+		// the empty value.
+		switch {
+		case value == "":
+			target += "/" + name + "@base64/="
+		case url.QueryEscape(value) != value:
+			target += "/" + name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+		default:
+			target += "/" + name + "/" + value
+		}
+	}
+	req, err := http.NewRequest("PUT", target, bytes.NewReader(metrics.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("pushgateway replied %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testMetricsReport() *RunReport {
+	config := testEnvironmentConfig()
+	config.Template = "https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json"
+	return &RunReport{
+		Environment:  config,
+		Start:        time.Unix(1475000000, 0),
+		Duration:     30 * time.Minute,
+		Provisioning: 12*time.Minute + 500*time.Millisecond,
+		Connect:      2 * time.Second,
+		Steps: []StepReport{
+			{Command: "docker version", Duration: time.Second},
+			{Command: `docker run dockerswarm/e2e go test -v -run "$DOCKER_E2E_TEST_RUN"`, Duration: 15 * time.Minute, Tests: []TestResult{
+				{Name: "TestServicesCreate", Status: TestPass, Duration: 90 * time.Second},
+				{Name: "TestServicesCreate/global", Status: TestPass, Duration: 30 * time.Second},
+			}},
+		},
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	labels := `instance_type="t2.micro",managers="3",template="https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",workers="5"`
+	metrics := string(runMetrics(testMetricsReport()).Bytes())
+	for _, line := range []string{
+		"# TYPE docker_e2e_provision_duration_seconds gauge",
+		"docker_e2e_provision_duration_seconds{" + labels + "} 720.5",
+		"docker_e2e_ssh_connect_duration_seconds{" + labels + "} 2",
+		"docker_e2e_run_success{" + labels + "} 1",
+		"docker_e2e_run_start_timestamp_seconds{" + labels + "} 1.475e+09",
+		`docker_e2e_command_duration_seconds{instance_type="t2.micro",managers="3",step="step-01",template="https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",workers="5"} 1`,
+		`docker_e2e_command_duration_seconds{instance_type="t2.micro",managers="3",step="step-02",template="https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",workers="5"} 900`,
+		`docker_e2e_test_duration_seconds{instance_type="t2.micro",managers="3",template="https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",test="TestServicesCreate",workers="5"} 90`,
+		`docker_e2e_test_duration_seconds{instance_type="t2.micro",managers="3",template="https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json",test="TestServicesCreate/global",workers="5"} 30`,
+	} {
+		assert.Contains(t, strings.Split(metrics, "\n"), line)
+	}
+
+	failed := testMetricsReport()
+	failed.Error = "exit status 1"
+	assert.Equal(t, runMetrics(failed).Bytes(), runMetrics(failed).Bytes(), "output must be stable")
+	assert.Contains(t, string(runMetrics(failed).Bytes()), "docker_e2e_run_success{"+labels+"} 0\n")
+
+	notProvisioned := &RunReport{Environment: testEnvironmentConfig(), Error: "over budget"}
+	assert.NotContains(t, string(runMetrics(notProvisioned).Bytes()), "docker_e2e_provision_duration_seconds")
+}
+
+func TestExportMetrics(t *testing.T) {
+	var mu sync.Mutex
+	var method, contentType string
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		bodies[r.URL.Path] = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	textfile := filepath.Join(dir, "docker_e2e.prom")
+	report := testMetricsReport()
+	exportMetrics(&MetricsConfig{Pushgateway: server.URL + "/", Job: "nightly", Textfile: textfile}, "e2e.yml", report)
+
+	expected := string(runMetrics(report).Bytes())
+	assert.Equal(t, "PUT", method)
+	assert.Contains(t, contentType, "version=0.0.4")
+	assert.Equal(t, map[string]string{"/metrics/job/nightly/config/e2e.yml": expected}, bodies)
+
+	data, err := ioutil.ReadFile(textfile)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files must be removed")
+
+	// Matrix runs are pushed separately, in groups of their own.
+	bodies = map[string]string{}
+	first, second := testMetricsReport(), testMetricsReport()
+	first.Name, second.Name = "template0-m3-w5-t2.micro", "template0-m5-w5-t2.micro"
+	exportMetrics(&MetricsConfig{Pushgateway: server.URL}, "configs/e2e.yml", first, second)
+	assert.Equal(t, map[string]string{
+		"/metrics/job/docker_e2e/config@base64/Y29uZmlncy9lMmUueW1s/run/template0-m3-w5-t2.micro": string(runMetrics(first).Bytes()),
+		"/metrics/job/docker_e2e/config@base64/Y29uZmlncy9lMmUueW1s/run/template0-m5-w5-t2.micro": string(runMetrics(second).Bytes()),
+	}, bodies)
+}
+
+func TestMetricsProblems(t *testing.T) {
+	var config *MetricsConfig
+	assert.Empty(t, config.problems())
+	assert.Empty(t, (&MetricsConfig{Pushgateway: "http://pushgateway:9091"}).problems())
+	assert.Len(t, (&MetricsConfig{}).problems(), 1)
+	assert.Len(t, (&MetricsConfig{Pushgateway: "pushgateway"}).problems(), 1)
+	assert.Len(t, (&MetricsConfig{Textfile: "/var/lib/node_exporter/docker_e2e.txt"}).problems(), 1)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStackPrefix = "docker-e2e"
+
+	// maxStackNameLength is the longest stack name CloudFormation accepts.
+	maxStackNameLength = 128
+	// maxStackPrefixLength leaves room for the date, owner, job and suffix.
+	maxStackPrefixLength = 64
+
+	suffixLength   = 6
+	suffixAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	// nameAttempts is how many names are tried before giving up. Suffixes
+	// are random, so collisions are only expected from a broken generator.
+	nameAttempts = 10
+)
+
+// Stack names must start with a letter and only contain alphanumerics and
+// hyphens.
+var (
+	stackPrefixPattern = regexp.MustCompile(`^[a-zA-Z][-a-zA-Z0-9]*$`)
+	invalidNameChars   = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// stackNameSuffix returns the random part of stack names.
+var stackNameSuffix = randomSuffix
+
+// Naming configures the names of the stacks of an environment. Names are
+// built as <prefix>-<YYYYMMDD>-<owner>-<job>-<suffix>.
+type Naming struct {
+	// Prefix defaults to "docker-e2e". Stacks are only purged if they have
+	// the prefix given to purge.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Owner defaults to the local user.
+	Owner string `yaml:"owner,omitempty"`
+	// Job identifies the CI build, e.g. ${BUILD_TAG}.
+	Job string `yaml:"job,omitempty"`
+}
+
+// problems returns the invalid settings of the naming.
+func (n *Naming) problems() []string {
+	problems := []string{}
+	if n == nil || n.Prefix == "" {
+		return problems
+	}
+	if !stackPrefixPattern.MatchString(n.Prefix) {
+		problems = append(problems, fmt.Sprintf("environment.naming.prefix: must start with a letter and only contain letters, digits and hyphens, got %q", n.Prefix))
+	}
+	if len(n.Prefix) > maxStackPrefixLength {
+		problems = append(problems, fmt.Sprintf("environment.naming.prefix: must be at most %d characters long", maxStackPrefixLength))
+	}
+	return problems
+}
+
+// NameAllocator generates unique stack names.
+type NameAllocator struct {
+	prefix string
+	// info identifies the owner and job, already sanitized.
+	info string
+}
+
+// NewNameAllocator returns an allocator following naming, which may be nil.
+func NewNameAllocator(naming *Naming) *NameAllocator {
+	if naming == nil {
+		naming = &Naming{}
+	}
+	a := &NameAllocator{prefix: naming.Prefix}
+	if a.prefix == "" {
+		a.prefix = defaultStackPrefix
+	}
+
+	owner := naming.Owner
+	if owner == "" {
+		if usr, err := user.Current(); err == nil {
+			owner = usr.Username
+		}
+	}
+	parts := []string{}
+	for _, s := range []string{owner, naming.Job} {
+		if s = sanitizeNamePart(s); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	a.info = strings.Join(parts, "-")
+	return a
+}
+
+// Name returns a new candidate name.
+func (a *NameAllocator) Name() string {
+	head := fmt.Sprintf("%s-%s-", a.prefix, time.Now().Format("20060102"))
+	tail := stackNameSuffix()
+	if a.info == "" {
+		return head + tail
+	}
+
+	// Shorten the owner and job rather than the parts making names unique.
+	info := a.info
+	if room := maxStackNameLength - len(head) - len(tail) - 1; len(info) > room {
+		info = strings.TrimRight(info[:room], "-")
+	}
+	if info == "" {
+		return head + tail
+	}
+	return head + info + "-" + tail
+}
+
+// Provision creates an environment, retrying with new names as long as they
+// are already taken.
+func (a *NameAllocator) Provision(cf cloudformationiface.CloudFormationAPI, config *EnvironmentConfig) (*Environment, error) {
+	for i := 0; i < nameAttempts; i++ {
+		name := a.Name()
+		env, err := Provision(cf, name, config)
+		if isAlreadyExists(err) {
+			config.logger().Warnf("Stack %s already exists, trying another name", name)
+			continue
+		}
+		return env, err
+	}
+	return nil, errors.Errorf("unable to find a free stack name after %d attempts", nameAttempts)
+}
+
+func isAlreadyExists(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && aerr.Code() == cloudformation.ErrCodeAlreadyExistsException
+}
+
+// sanitizeNamePart turns s into something allowed in stack names.
+func sanitizeNamePart(s string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func randomSuffix() string {
+	b := make([]byte, suffixLength)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the clock, collisions are still detected.
+		s := fmt.Sprintf("%x", time.Now().UnixNano())
+		return s[len(s)-suffixLength:]
+	}
+	for i := range b {
+		b[i] = suffixAlphabet[int(b[i])%len(suffixAlphabet)]
+	}
+	return string(b)
+}
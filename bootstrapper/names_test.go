@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// fixedSuffixes makes stack names end with suffixes, in order, the last one
+// being repeated. The returned function restores random suffixes.
+func fixedSuffixes(suffixes ...string) func() {
+	stackNameSuffix = func() string {
+		s := suffixes[0]
+		if len(suffixes) > 1 {
+			suffixes = suffixes[1:]
+		}
+		return s
+	}
+	return func() { stackNameSuffix = randomSuffix }
+}
+
+func TestName(t *testing.T) {
+	defer fixedSuffixes("a1b2c3")()
+	date := time.Now().Format("20060102")
+
+	for _, c := range []struct {
+		naming *Naming
+		name   string
+	}{
+		{&Naming{Owner: "ci"}, "docker-e2e-" + date + "-ci-a1b2c3"},
+		{&Naming{Prefix: "swarm", Owner: "ci", Job: "nightly"}, "swarm-" + date + "-ci-nightly-a1b2c3"},
+		{&Naming{Owner: "Jane.Doe", Job: "jenkins-e2e/master #42"}, "docker-e2e-" + date + "-jane-doe-jenkins-e2e-master-42-a1b2c3"},
+		{&Naming{Owner: "__"}, "docker-e2e-" + date + "-a1b2c3"},
+	} {
+		assert.Equal(t, c.name, NewNameAllocator(c.naming).Name())
+	}
+
+	long := NewNameAllocator(&Naming{Owner: "ci", Job: strings.Repeat("x", 200)}).Name()
+	assert.Len(t, long, maxStackNameLength)
+	assert.True(t, strings.HasPrefix(long, "docker-e2e-"+date+"-ci-xxx"), long)
+	assert.True(t, strings.HasSuffix(long, "x-a1b2c3"), long)
+}
+
+func TestRandomSuffix(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		s := randomSuffix()
+		assert.Len(t, s, suffixLength)
+		assert.Equal(t, s, sanitizeNamePart(s))
+		assert.False(t, seen[s], "duplicate suffix %s", s)
+		seen[s] = true
+	}
+}
+
+func TestNameAllocatorCollision(t *testing.T) {
+	defer fixedSuffixes("aaaaaa", "bbbbbb", "cccccc")()
+	cf := newFakeCloudFormation()
+	naming := &Naming{Owner: "ci"}
+	prefix := "docker-e2e-" + time.Now().Format("20060102") + "-ci-"
+	cf.AddStack(prefix+"aaaaaa", cloudformation.StackStatusCreateComplete, time.Now())
+	cf.AddStack(prefix+"bbbbbb", cloudformation.StackStatusCreateComplete, time.Now())
+
+	env, err := NewNameAllocator(naming).Provision(cf, testEnvironmentConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, prefix+"cccccc", *cf.Stack(env.id).StackName)
+}
+
+func TestNameAllocatorExhausted(t *testing.T) {
+	defer fixedSuffixes("aaaaaa")()
+	cf := newFakeCloudFormation()
+	naming := &Naming{Owner: "ci"}
+	cf.AddStack(NewNameAllocator(naming).Name(), cloudformation.StackStatusCreateComplete, time.Now())
+
+	env, err := NewNameAllocator(naming).Provision(cf, testEnvironmentConfig())
+	assert.Nil(t, env)
+	assert.Error(t, err)
+}
+
+func TestNamingValidation(t *testing.T) {
+	config := testEnvironmentConfig()
+	for _, prefix := range []string{"", "swarm", "e2e-Nightly-2"} {
+		config.Naming = &Naming{Prefix: prefix}
+		assert.NoError(t, config.Validate(), prefix)
+	}
+	for _, prefix := range []string{"2e2", "docker_e2e", "-e2e", strings.Repeat("e", maxStackPrefixLength+1)} {
+		config.Naming = &Naming{Prefix: prefix}
+		assert.Error(t, config.Validate(), prefix)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGitHubAPIURL  = "https://api.github.com"
+	defaultGitHubContext = "docker-e2e"
+	// maxGitHubDescription is the longest description of a commit status.
+	maxGitHubDescription = 140
+)
+
+// NotifyConfig lists where the summary of a run is posted once it is done.
+// URLs and tokens are read like env values, so they can be kept out of the
+// config.
+//
+//	notify:
+//	  artifacts_url: https://jenkins.dockerproject.org/job/e2e/${BUILD_NUMBER}/artifact/
+//	  webhook: https://ci.example.com/e2e
+//	  slack:
+//	    from_env: SLACK_WEBHOOK_URL
+//	  github:
+//	    repository: docker/docker
+//	    sha: ${GIT_COMMIT}
+//	    token:
+//	      from_env: GITHUB_TOKEN
+type NotifyConfig struct {
+	// ArtifactsURL is where the artifacts of the run can be browsed.
+	ArtifactsURL string `yaml:"artifacts_url,omitempty"`
+
+	// Webhook receives the summary as JSON.
+	Webhook *EnvValue `yaml:"webhook,omitempty"`
+	// Slack is an incoming webhook of Slack.
+	Slack *EnvValue `yaml:"slack,omitempty"`
+	// GitHub sets the status of a commit.
+	GitHub *GitHubStatusConfig `yaml:"github,omitempty"`
+}
+
+// GitHubStatusConfig is the commit whose status reports the result of runs.
+type GitHubStatusConfig struct {
+	Repository string   `yaml:"repository,omitempty"`
+	SHA        string   `yaml:"sha,omitempty"`
+	Token      EnvValue `yaml:"token,omitempty"`
+	// Context distinguishes the status from the ones of other CI jobs.
+	// Defaults to docker-e2e.
+	Context string `yaml:"context,omitempty"`
+	// APIURL is the API of GitHub Enterprise, if not github.com.
+	APIURL string `yaml:"api_url,omitempty"`
+}
+
+func (c *NotifyConfig) problems() []string {
+	problems := []string{}
+	if c == nil {
+		return problems
+	}
+	urls := map[string]EnvValue{}
+	if c.Webhook != nil {
+		urls["webhook"] = *c.Webhook
+	}
+	if c.Slack != nil {
+		urls["slack"] = *c.Slack
+	}
+	problems = append(problems, envProblems("notify", urls)...)
+	if g := c.GitHub; g != nil {
+		if !strings.Contains(g.Repository, "/") {
+			problems = append(problems, fmt.Sprintf("notify.github.repository: expected owner/name, got %q", g.Repository))
+		}
+		if g.SHA == "" {
+			problems = append(problems, "notify.github.sha is missing")
+		}
+		if g.Token == (EnvValue{}) {
+			problems = append(problems, "notify.github.token is missing")
+		}
+		problems = append(problems, envProblems("notify.github", map[string]EnvValue{"token": g.Token})...)
+	}
+	return problems
+}
+
+// Summary is what notifiers are told about a run. Runs of a matrix are
+// summarized together.
+type Summary struct {
+	Config  string `json:"config"`
+	Success bool   `json:"success"`
+
+	Runs       int `json:"runs"`
+	FailedRuns int `json:"failed_runs"`
+
+	// Passed, Failed and Skipped count the top-level tests.
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+	// FailingTests are the failed tests, prefixed with the name of their
+	// run in a matrix. Quarantined tests are listed separately.
+	FailingTests []string `json:"failing_tests,omitempty"`
+	Quarantined  []string `json:"quarantined,omitempty"`
+	// Errors are the reasons runs failed.
+	Errors []string `json:"errors,omitempty"`
+
+	Duration     time.Duration `json:"duration"`
+	StackIDs     []string      `json:"stack_ids,omitempty"`
+	ArtifactsURL string        `json:"artifacts_url,omitempty"`
+}
+
+// newSummary summarizes the reports of a run of config.
+func newSummary(config string, artifactsURL string, reports ...*RunReport) *Summary {
+	s := &Summary{
+		Config:       config,
+		Success:      true,
+		Runs:         len(reports),
+		ArtifactsURL: artifactsURL,
+	}
+	for _, r := range reports {
+		prefix := ""
+		if r.Name != "" {
+			prefix = r.Name + ": "
+		}
+		if r.Failed() {
+			s.Success = false
+			s.FailedRuns++
+			s.Errors = append(s.Errors, prefix+r.Error)
+		}
+		if r.StackID != "" {
+			s.StackIDs = append(s.StackIDs, r.StackID)
+		}
+		if r.Duration > s.Duration {
+			// Runs of a matrix are concurrent.
+			s.Duration = r.Duration
+		}
+
+		quarantined := map[string]bool{}
+		for _, name := range r.Quarantined() {
+			quarantined[name] = true
+			s.Quarantined = append(s.Quarantined, prefix+name)
+		}
+		for _, t := range r.Tests() {
+			if strings.Contains(t.Name, "/") {
+				continue
+			}
+			switch {
+			case t.Status == TestPass:
+				s.Passed++
+			case t.Status == TestSkip:
+				s.Skipped++
+			case !quarantined[t.Name]:
+				s.Failed++
+				s.FailingTests = append(s.FailingTests, prefix+t.Name)
+			}
+		}
+	}
+	return s
+}
+
+// Title is a one-line description of the outcome.
+func (s *Summary) Title() string {
+	result := "passed"
+	if !s.Success {
+		result = "failed"
+	}
+	title := fmt.Sprintf("%s %s: %d passed, %d failed", s.Config, result, s.Passed, s.Failed)
+	if s.Skipped > 0 {
+		title += fmt.Sprintf(", %d skipped", s.Skipped)
+	}
+	if s.Runs > 1 {
+		title += fmt.Sprintf(" (%d of %d runs failed)", s.FailedRuns, s.Runs)
+	}
+	return title + fmt.Sprintf(" in %v", s.Duration-s.Duration%time.Second)
+}
+
+// Notifier posts the summary of runs somewhere.
+type Notifier interface {
+	Notify(summary *Summary) error
+}
+
+// newNotifiers returns the notifiers of config, with their URLs and tokens
+// resolved.
+func newNotifiers(config *NotifyConfig) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	if config == nil {
+		return notifiers, nil
+	}
+	if config.Webhook != nil {
+		target, err := config.Webhook.Resolve()
+		if err != nil {
+			return nil, errors.Wrap(err, "notify.webhook")
+		}
+		notifiers = append(notifiers, &webhookNotifier{url: target})
+	}
+	if config.Slack != nil {
+		target, err := config.Slack.Resolve()
+		if err != nil {
+			return nil, errors.Wrap(err, "notify.slack")
+		}
+		notifiers = append(notifiers, &slackNotifier{url: target})
+	}
+	if g := config.GitHub; g != nil {
+		token, err := g.Token.Resolve()
+		if err != nil {
+			return nil, errors.Wrap(err, "notify.github.token")
+		}
+		n := &githubNotifier{
+			apiURL:     strings.TrimSuffix(g.APIURL, "/"),
+			repository: g.Repository,
+			sha:        g.SHA,
+			token:      token,
+			context:    g.Context,
+		}
+		if n.apiURL == "" {
+			n.apiURL = defaultGitHubAPIURL
+		}
+		if n.context == "" {
+			n.context = defaultGitHubContext
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// notifyRun posts the summary of the reports of a run to the notifiers of
+// config. Failing to do so doesn't fail the run.
+func notifyRun(config *Config, path string, reports ...*RunReport) {
+	if config.Notify == nil {
+		return
+	}
+	notifiers, err := newNotifiers(config.Notify)
+	if err != nil {
+		config.logger().Errorf("Unable to send notifications: %v", err)
+		return
+	}
+	summary := newSummary(path, config.Notify.ArtifactsURL, reports...)
+	for _, n := range notifiers {
+		if err := n.Notify(summary); err != nil {
+			config.logger().Errorf("Unable to send notification: %v", err)
+		}
+	}
+}
+
+// webhookNotifier posts the summary as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Notify(summary *Summary) error {
+	return postJSON(n.url, nil, summary)
+}
+
+// slackNotifier posts the summary to an incoming webhook of Slack.
+type slackNotifier struct {
+	url string
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Text   string       `json:"text,omitempty"`
+	Fields []slackField `json:"fields,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (n *slackNotifier) Notify(summary *Summary) error {
+	attachment := slackAttachment{Color: "good"}
+	if !summary.Success {
+		attachment.Color = "danger"
+	}
+	lists := []struct {
+		title string
+		items []string
+	}{
+		{"Failing tests", summary.FailingTests},
+		{"Quarantined", summary.Quarantined},
+		{"Errors", summary.Errors},
+		{"Stacks", summary.StackIDs},
+	}
+	for _, l := range lists {
+		if len(l.items) > 0 {
+			attachment.Fields = append(attachment.Fields, slackField{Title: l.title, Value: strings.Join(l.items, "\n")})
+		}
+	}
+
+	text := summary.Title()
+	if summary.ArtifactsURL != "" {
+		text += fmt.Sprintf(" (<%s|artifacts>)", summary.ArtifactsURL)
+	}
+	return postJSON(n.url, nil, &slackMessage{
+		Text:        text,
+		Attachments: []slackAttachment{attachment},
+	})
+}
+
+// githubNotifier sets the status of a commit.
+type githubNotifier struct {
+	apiURL     string
+	repository string
+	sha        string
+	token      string
+	context    string
+}
+
+type githubStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func (n *githubNotifier) Notify(summary *Summary) error {
+	status := &githubStatus{
+		State:       "success",
+		TargetURL:   summary.ArtifactsURL,
+		Description: summary.Title(),
+		Context:     n.context,
+	}
+	if !summary.Success {
+		status.State = "failure"
+	}
+	status.Description = truncate(status.Description, maxGitHubDescription)
+	target := fmt.Sprintf("%s/repos/%s/statuses/%s", n.apiURL, n.repository, n.sha)
+	return postJSON(target, map[string]string{"Authorization": "token " + n.token}, status)
+}
+
+// truncate shortens s to max characters, ending with "..." if it was cut.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+// postJSON posts payload to target, failing unless it is accepted.
+func postJSON(target string, headers map[string]string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may hold a secret, as for Slack, only mention its host.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return errors.Wrapf(err, "unable to reach %s", req.URL.Host)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%s replied %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// notifyRequest is a request received by a testNotifyServer.
+type notifyRequest struct {
+	Path          string
+	Authorization string
+	Body          map[string]interface{}
+}
+
+// testNotifyServer stands in for the webhooks and the GitHub API.
+type testNotifyServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []notifyRequest
+}
+
+func newTestNotifyServer(t *testing.T) *testNotifyServer {
+	s := &testNotifyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		req := notifyRequest{Path: r.URL.Path, Authorization: r.Header.Get("Authorization")}
+		if err := json.Unmarshal(data, &req.Body); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("invalid JSON posted to %s: %s", r.URL.Path, data)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/broken") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	return s
+}
+
+func (s *testNotifyServer) Received() map[string]notifyRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := map[string]notifyRequest{}
+	for _, r := range s.requests {
+		requests[r.Path] = r
+	}
+	return requests
+}
+
+func testReports() []*RunReport {
+	return []*RunReport{
+		{
+			Name:     "template0-m3-w5-t2.micro",
+			StackID:  "arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e-1/1",
+			Duration: 20 * time.Minute,
+			Steps: []StepReport{{
+				Tests: []TestResult{
+					{Name: "TestServicesCreate", Status: TestPass},
+					{Name: "TestServicesCreate/global", Status: TestPass},
+					{Name: "TestNetworkExternalLb", Status: TestFail},
+					{Name: "TestServicesRollingUpdateSucceed", Status: TestFail},
+					{Name: "TestSecrets", Status: TestSkip},
+				},
+				Quarantined: []string{"TestServicesRollingUpdateSucceed"},
+			}},
+			Error: "exit status 1",
+		},
+		{
+			Name:     "template1-m3-w5-t2.micro",
+			StackID:  "arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e-2/2",
+			Duration: 25*time.Minute + 300*time.Millisecond,
+			Steps: []StepReport{{
+				Tests: []TestResult{
+					{Name: "TestServicesCreate", Status: TestPass},
+					{Name: "TestNetworkExternalLb", Status: TestPass},
+				},
+			}},
+		},
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := newSummary("e2e.yml", "https://ci.example.com/42/", testReports()...)
+	assert.False(t, s.Success)
+	assert.Equal(t, 2, s.Runs)
+	assert.Equal(t, 1, s.FailedRuns)
+	assert.Equal(t, 3, s.Passed)
+	assert.Equal(t, 1, s.Failed)
+	assert.Equal(t, 1, s.Skipped)
+	assert.Equal(t, []string{"template0-m3-w5-t2.micro: TestNetworkExternalLb"}, s.FailingTests)
+	assert.Equal(t, []string{"template0-m3-w5-t2.micro: TestServicesRollingUpdateSucceed"}, s.Quarantined)
+	assert.Equal(t, []string{"template0-m3-w5-t2.micro: exit status 1"}, s.Errors)
+	assert.Len(t, s.StackIDs, 2)
+	assert.Equal(t, "e2e.yml failed: 3 passed, 1 failed, 1 skipped (1 of 2 runs failed) in 25m0s", s.Title())
+
+	s = newSummary("e2e.yml", "", testReports()[1])
+	assert.True(t, s.Success)
+	assert.Equal(t, "e2e.yml passed: 2 passed, 0 failed in 25m0s", s.Title())
+}
+
+func TestNotifiers(t *testing.T) {
+	server := newTestNotifyServer(t)
+	defer server.Close()
+	os.Setenv("DOCKER_E2E_TEST_GITHUB_TOKEN", "s3cr3t")
+	defer os.Unsetenv("DOCKER_E2E_TEST_GITHUB_TOKEN")
+
+	config := &Config{Notify: &NotifyConfig{
+		ArtifactsURL: "https://ci.example.com/42/",
+		Webhook:      &EnvValue{Value: server.URL + "/webhook"},
+		Slack:        &EnvValue{Value: server.URL + "/slack"},
+		GitHub: &GitHubStatusConfig{
+			Repository: "docker/docker",
+			SHA:        "0123456789abcdef",
+			Token:      EnvValue{FromEnv: "DOCKER_E2E_TEST_GITHUB_TOKEN"},
+			APIURL:     server.URL + "/api/v3/",
+		},
+	}}
+	notifyRun(config, "e2e.yml", testReports()...)
+
+	received := server.Received()
+	assert.Len(t, received, 3)
+
+	webhook := received["/webhook"].Body
+	assert.Equal(t, "e2e.yml", webhook["config"])
+	assert.Equal(t, false, webhook["success"])
+	assert.Equal(t, float64(1), webhook["failed"])
+	assert.Equal(t, []interface{}{"template0-m3-w5-t2.micro: TestNetworkExternalLb"}, webhook["failing_tests"])
+	assert.Equal(t, "https://ci.example.com/42/", webhook["artifacts_url"])
+
+	slack := received["/slack"].Body
+	assert.Contains(t, slack["text"], "e2e.yml failed")
+	assert.Contains(t, slack["text"], "<https://ci.example.com/42/|artifacts>")
+	attachment := slack["attachments"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "danger", attachment["color"])
+	assert.Contains(t, attachment["fields"].([]interface{})[0], "title")
+
+	github, ok := received["/api/v3/repos/docker/docker/statuses/0123456789abcdef"]
+	assert.True(t, ok, "%v", received)
+	assert.Equal(t, "token s3cr3t", github.Authorization)
+	assert.Equal(t, "failure", github.Body["state"])
+	assert.Equal(t, "docker-e2e", github.Body["context"])
+	assert.Equal(t, "https://ci.example.com/42/", github.Body["target_url"])
+	assert.True(t, len(github.Body["description"].(string)) <= maxGitHubDescription)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 10))
+	assert.Equal(t, "éééééé...", truncate(strings.Repeat("é", 20), 9))
+	assert.True(t, utf8.ValidString(truncate(strings.Repeat("é", 200), maxGitHubDescription)))
+}
+
+func TestNotifyErrors(t *testing.T) {
+	server := newTestNotifyServer(t)
+	defer server.Close()
+
+	n := &webhookNotifier{url: server.URL + "/broken/s3cr3t"}
+	err := n.Notify(newSummary("e2e.yml", ""))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+	assert.NotContains(t, err.Error(), "s3cr3t", "URLs may hold secrets")
+
+	n = &webhookNotifier{url: "http://127.0.0.1:1/s3cr3t"}
+	err = n.Notify(newSummary("e2e.yml", ""))
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "s3cr3t", "URLs may hold secrets")
+
+	_, err = newNotifiers(&NotifyConfig{Slack: &EnvValue{FromEnv: "DOCKER_E2E_TEST_UNSET"}})
+	assert.Error(t, err)
+}
+
+func TestNotifyProblems(t *testing.T) {
+	var config *NotifyConfig
+	assert.Empty(t, config.problems())
+
+	config = &NotifyConfig{
+		Slack:  &EnvValue{Value: "https://hooks.slack.com/services/T/B/X", FromEnv: "SLACK_WEBHOOK_URL"},
+		GitHub: &GitHubStatusConfig{Repository: "docker"},
+	}
+	assert.Equal(t, []string{
+		"notify.slack: only one of value, from_env and from_file can be set",
+		`notify.github.repository: expected owner/name, got "docker"`,
+		"notify.github.sha is missing",
+		"notify.github.token is missing",
+	}, config.problems())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+// endpointVar is the variable the e2e tests read the address of the
+// environment from.
+const endpointVar = "DOCKER_E2E_ENDPOINT"
+
+// Outputs are the outputs of the stack of an environment. The ones of the
+// Docker for AWS templates have their own field, all of them are in All.
+type Outputs struct {
+	StackID string `json:"stack_id"`
+
+	// SSH is the command to connect to a manager, e.g.
+	// "ssh docker@docker-e2e-20160928-ELB-SSH-1653593963.us-east-1.elb.amazonaws.com".
+	SSH string `json:"ssh,omitempty"`
+	// DefaultDNSTarget is the DNS name of the load balancer in front of the
+	// published ports.
+	DefaultDNSTarget string `json:"default_dns_target,omitempty"`
+	ELBDNSZoneID     string `json:"elb_dns_zone_id,omitempty"`
+	VPCID            string `json:"vpc_id,omitempty"`
+
+	SwarmWideSecurityGroupID string `json:"swarm_wide_security_group_id,omitempty"`
+	ManagerSecurityGroupID   string `json:"manager_security_group_id,omitempty"`
+	NodeSecurityGroupID      string `json:"node_security_group_id,omitempty"`
+
+	All map[string]string `json:"all"`
+}
+
+// newOutputs reads the outputs of stack.
+func newOutputs(stack *cloudformation.Stack) *Outputs {
+	o := &Outputs{
+		StackID: aws.StringValue(stack.StackId),
+		All:     make(map[string]string),
+	}
+	for _, output := range stack.Outputs {
+		o.All[aws.StringValue(output.OutputKey)] = aws.StringValue(output.OutputValue)
+	}
+
+	o.SSH = o.All["SSH"]
+	o.DefaultDNSTarget = o.All["DefaultDNSTarget"]
+	o.ELBDNSZoneID = o.All["ELBDNSZoneID"]
+	o.VPCID = o.All["VPCID"]
+	o.SwarmWideSecurityGroupID = o.All["SwarmWideSecurityGroupID"]
+	o.ManagerSecurityGroupID = o.All["ManagerSecurityGroupID"]
+	o.NodeSecurityGroupID = o.All["NodeSecurityGroupID"]
+	return o
+}
+
+// SSHEndpoint returns the host:port to connect to a manager.
+func (o *Outputs) SSHEndpoint() (string, error) {
+	if o.SSH == "" {
+		return "", errors.New("unable to retrieve SSH endpoint")
+	}
+	return parseSSHOutput(o.SSH)
+}
+
+// Env returns the variables passed to the commands of a run.
+func (o *Outputs) Env() map[string]EnvValue {
+	env := map[string]EnvValue{}
+	if o.DefaultDNSTarget != "" {
+		env[endpointVar] = EnvValue{Value: o.DefaultDNSTarget}
+	}
+	return env
+}
+
+// EnvFile formats the outputs as a file of KEY=value lines, which can be
+// sourced by a shell or given to docker run --env-file.
+func (o *Outputs) EnvFile() []byte {
+	vars := map[string]string{"DOCKER_E2E_STACK_ID": o.StackID}
+	if o.DefaultDNSTarget != "" {
+		vars[endpointVar] = o.DefaultDNSTarget
+	}
+	for k, v := range o.All {
+		vars["DOCKER_E2E_OUTPUT_"+envName(k)] = v
+	}
+
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		// docker run --env-file doesn't support quoting, keep values on a
+		// single line instead.
+		fmt.Fprintf(&buf, "%s=%s\n", name, strings.Replace(vars[name], "\n", " ", -1))
+	}
+	return buf.Bytes()
+}
+
+// write saves the outputs as outputs.json and outputs.env.
+func (o *Outputs) write(artifacts *Artifacts) error {
+	if artifacts == nil {
+		return nil
+	}
+	if err := writeJSON(artifacts.Path("outputs.json"), o); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(artifacts.Path("outputs.env"), o.EnvFile(), 0644)
+}
+
+// envName turns an output key such as "DefaultDNSTarget" into
+// "DEFAULT_DNS_TARGET".
+func envName(key string) string {
+	runes := []rune(key)
+	var buf bytes.Buffer
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			buf.WriteRune('_')
+			continue
+		}
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				buf.WriteRune('_')
+			}
+		}
+		buf.WriteRune(unicode.ToUpper(r))
+	}
+	return buf.String()
+}
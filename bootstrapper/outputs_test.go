@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, name := range map[string]string{
+		"SSH":                      "SSH",
+		"DefaultDNSTarget":         "DEFAULT_DNS_TARGET",
+		"ELBDNSZoneID":             "ELBDNS_ZONE_ID",
+		"VPCID":                    "VPCID",
+		"SwarmWideSecurityGroupID": "SWARM_WIDE_SECURITY_GROUP_ID",
+		"Managers":                 "MANAGERS",
+		"Zone2Subnet":              "ZONE2_SUBNET",
+		"my-output":                "MY_OUTPUT",
+	} {
+		assert.Equal(t, name, envName(key), key)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	outputs := newOutputs(&cloudformation.Stack{
+		StackId: aws.String("arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e-20160928-0/1"),
+		Outputs: []*cloudformation.Output{
+			{OutputKey: aws.String("SSH"), OutputValue: aws.String("ssh docker@10.0.0.1")},
+			{OutputKey: aws.String("DefaultDNSTarget"), OutputValue: aws.String("docker-e2e-ELB-1.us-east-1.elb.amazonaws.com")},
+			{OutputKey: aws.String("VPCID"), OutputValue: aws.String("vpc-1234")},
+		},
+	})
+
+	endpoint, err := outputs.SSHEndpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:22", endpoint)
+	assert.Equal(t, "vpc-1234", outputs.VPCID)
+	assert.Equal(t, map[string]EnvValue{
+		"DOCKER_E2E_ENDPOINT": {Value: "docker-e2e-ELB-1.us-east-1.elb.amazonaws.com"},
+	}, outputs.Env())
+
+	assert.Equal(t, `DOCKER_E2E_ENDPOINT=docker-e2e-ELB-1.us-east-1.elb.amazonaws.com
+DOCKER_E2E_OUTPUT_DEFAULT_DNS_TARGET=docker-e2e-ELB-1.us-east-1.elb.amazonaws.com
+DOCKER_E2E_OUTPUT_SSH=ssh docker@10.0.0.1
+DOCKER_E2E_OUTPUT_VPCID=vpc-1234
+DOCKER_E2E_STACK_ID=arn:aws:cloudformation:us-east-1:123456789012:stack/docker-e2e-20160928-0/1
+`, string(outputs.EnvFile()))
+
+	_, err = newOutputs(&cloudformation.Stack{}).SSHEndpoint()
+	assert.Error(t, err)
+}
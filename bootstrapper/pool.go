@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// poolTag is set on pool stacks, with the pool key as value.
+	poolTag = "docker-e2e-pool"
+
+	// leaseTTL is how long a lease stays valid without heartbeat.
+	leaseTTL = 5 * time.Minute
+	// heartbeatInterval is how often lease holders extend their lease.
+	heartbeatInterval = time.Minute
+)
+
+// poolPollInterval is how often Acquire checks for an available environment.
+var poolPollInterval = 30 * time.Second
+
+// defaultResetCommands remove the services left by the tests.
+var defaultResetCommands = []string{
+	"docker service ls -q --filter label=e2etesting | xargs -r docker service rm",
+}
+
+// PoolConfig configures the warm environment pool of a config. The pool is
+// filled by "pool maintain", which must keep running while runs use it; a run
+// destroying its environment also provisions a replacement before exiting.
+type PoolConfig struct {
+	// Size is the number of ready environments kept in the pool.
+	Size int `yaml:"size,omitempty"`
+
+	// Reset commands clean an environment after a successful run so it can
+	// be reused. Defaults to removing the e2e services.
+	Reset []string `yaml:"reset,omitempty"`
+}
+
+// PoolStack is an environment of a pool, recorded in the state.
+type PoolStack struct {
+	StackID string    `json:"stack_id"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+
+	// Lease is set while the environment is used by a run.
+	Lease *Lease `json:"lease,omitempty"`
+}
+
+// Lease grants a run exclusive use of a pool environment. It expires unless
+// renewed by heartbeats.
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return l.Expires.Before(now)
+}
+
+// poolKey identifies the environments interchangeable for a given config.
+func poolKey(config *EnvironmentConfig) string {
+	env := *config
+	env.JumpHosts = nil
+	env.SSHKeyFile = ""
+	env.KnownHosts = ""
+	env.Naming = nil
+	data, _ := yaml.Marshal(env)
+	return fmt.Sprintf("%x", sha1.Sum(data))[:12]
+}
+
+// Pool manages the warm environments of a config.
+type Pool struct {
+	cf     cloudformationiface.CloudFormationAPI
+	store  *StateStore
+	config *Config
+	key    string
+}
+
+// NewPool returns the pool of environments matching config.
+func NewPool(cf cloudformationiface.CloudFormationAPI, store *StateStore, config *Config) *Pool {
+	return &Pool{
+		cf:     cf,
+		store:  store,
+		config: config,
+		key:    poolKey(config.Environment),
+	}
+}
+
+// PoolLease is an environment leased from a pool. It must be released.
+type PoolLease struct {
+	*Environment
+
+	pool   *Pool
+	holder string
+	done   chan struct{}
+}
+
+// Acquire leases a ready environment, waiting up to timeout for one to be
+// available.
+func (p *Pool) Acquire(timeout time.Duration) (*PoolLease, error) {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var leased *PoolStack
+		err := p.store.Update(func(state *State) error {
+			now := time.Now()
+			for _, s := range state.Pool {
+				if s.Key == p.key && s.Lease == nil {
+					s.Lease = &Lease{Holder: holder, Expires: now.Add(leaseTTL)}
+					leased = s
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if leased != nil {
+			logrus.Infof("Leased %s from pool %s", leased.StackID, p.key)
+			lease := &PoolLease{
+				Environment: NewEnvironment(leased.StackID, p.cf, p.config.Environment),
+				pool:        p,
+				holder:      holder,
+				done:        make(chan struct{}),
+			}
+			go lease.heartbeat()
+			return lease, nil
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return nil, errors.Errorf("no environment available in pool %s after %v", p.key, timeout)
+		}
+		if wait > poolPollInterval {
+			wait = poolPollInterval
+		}
+		logrus.Infof("No environment available in pool %s, waiting for \"pool maintain\" to provision one...", p.key)
+		time.Sleep(wait)
+	}
+}
+
+// heartbeat extends the lease until it is released.
+func (l *PoolLease) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			err := l.pool.update(l.id, func(s *PoolStack) error {
+				if s.Lease == nil || s.Lease.Holder != l.holder {
+					return errors.New("lease lost")
+				}
+				s.Lease.Expires = time.Now().Add(leaseTTL)
+				return nil
+			})
+			if err != nil {
+				logrus.Errorf("Failed to renew lease of %s: %v", l.id, err)
+			}
+		}
+	}
+}
+
+// Release returns the environment to the pool after resetting it. If the run
+// failed (or the reset does), the environment is destroyed instead, so the
+// next run starts from a clean environment, and a new one is provisioned to
+// keep the pool filled.
+func (l *PoolLease) Release(healthy bool) error {
+	close(l.done)
+
+	if healthy {
+		if err := l.reset(); err != nil {
+			logrus.Errorf("Failed to reset %s: %v", l.id, err)
+			healthy = false
+		}
+	}
+
+	if !healthy {
+		logrus.Infof("Destroying %s", l.id)
+		if err := l.pool.remove(l.id); err != nil {
+			return err
+		}
+		if err := l.Destroy(); err != nil {
+			return err
+		}
+		return l.pool.fill()
+	}
+
+	logrus.Infof("Returning %s to pool %s", l.id, l.pool.key)
+	return l.pool.update(l.id, func(s *PoolStack) error {
+		s.Lease = nil
+		return nil
+	})
+}
+
+func (l *PoolLease) reset() error {
+	commands := defaultResetCommands
+	if l.pool.config.Pool != nil && len(l.pool.config.Pool.Reset) > 0 {
+		commands = l.pool.config.Pool.Reset
+	}
+
+	if err := l.Connect(); err != nil {
+		return err
+	}
+	defer l.Disconnect()
+
+	for _, cmd := range commands {
+		logrus.Infof("$ %s", cmd)
+		if _, err := l.Run(cmd, nil, nil, nil); err != nil {
+			return errors.Wrapf(err, "%q failed", cmd)
+		}
+	}
+	return nil
+}
+
+// update modifies a stack of the pool in the state.
+func (p *Pool) update(stackID string, fn func(*PoolStack) error) error {
+	return p.store.Update(func(state *State) error {
+		for _, s := range state.Pool {
+			if s.StackID == stackID {
+				return fn(s)
+			}
+		}
+		return errors.Errorf("stack %s is not in the pool", stackID)
+	})
+}
+
+// remove forgets a stack of the pool.
+func (p *Pool) remove(stackID string) error {
+	return p.store.Update(func(state *State) error {
+		pool := []*PoolStack{}
+		for _, s := range state.Pool {
+			if s.StackID != stackID {
+				pool = append(pool, s)
+			}
+		}
+		state.Pool = pool
+		return nil
+	})
+}
+
+// Maintain keeps the pool filled until stop is closed: environments whose
+// lease expired are destroyed, and new ones are provisioned to replace the
+// used ones.
+func (p *Pool) Maintain(interval time.Duration, stop <-chan struct{}) {
+	for {
+		if err := p.reap(); err != nil {
+			logrus.Errorf("Failed to reap pool %s: %v", p.key, err)
+		}
+		if err := p.fill(); err != nil {
+			logrus.Errorf("Failed to fill pool %s: %v", p.key, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// reap destroys the environments whose holder stopped sending heartbeats.
+func (p *Pool) reap() error {
+	expired := []string{}
+	err := p.store.Update(func(state *State) error {
+		now := time.Now()
+		pool := []*PoolStack{}
+		for _, s := range state.Pool {
+			if s.Key == p.key && s.Lease != nil && s.Lease.expired(now) {
+				expired = append(expired, s.StackID)
+				continue
+			}
+			pool = append(pool, s)
+		}
+		state.Pool = pool
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		logrus.Warnf("Lease of %s expired, destroying it", id)
+		if err := NewEnvironment(id, p.cf, nil).Destroy(); err != nil {
+			logrus.Errorf("Failed to destroy %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// fill provisions environments until the pool reaches its size.
+func (p *Pool) fill() error {
+	size := 0
+	if p.config.Pool != nil {
+		size = p.config.Pool.Size
+	}
+
+	for {
+		state, err := p.store.Load()
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, s := range state.Pool {
+			if s.Key == p.key {
+				count++
+			}
+		}
+		if count >= size {
+			return nil
+		}
+
+		logrus.Infof("Pool %s has %d/%d environments, provisioning one", p.key, count, size)
+		envConfig := *p.config.Environment
+		envConfig.Tags = map[string]string{poolTag: p.key}
+		for k, v := range p.config.Environment.Tags {
+			envConfig.Tags[k] = v
+		}
+		env, err := provisionEnvironment(p.cf, &envConfig)
+		if err != nil {
+			return err
+		}
+
+		err = p.store.Update(func(state *State) error {
+			state.Pool = append(state.Pool, &PoolStack{
+				StackID: env.id,
+				Key:     p.key,
+				Created: time.Now(),
+			})
+			return nil
+		})
+		if err != nil {
+			env.Destroy()
+			return err
+		}
+	}
+}
+
+// Drain destroys all the environments of the pool that are not leased.
+func (p *Pool) Drain() error {
+	drained := []string{}
+	err := p.store.Update(func(state *State) error {
+		pool := []*PoolStack{}
+		for _, s := range state.Pool {
+			if s.Key == p.key && s.Lease == nil {
+				drained = append(drained, s.StackID)
+				continue
+			}
+			pool = append(pool, s)
+		}
+		state.Pool = pool
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range drained {
+		logrus.Infof("Destroying %s", id)
+		if err := NewEnvironment(id, p.cf, nil).Destroy(); err != nil {
+			logrus.Errorf("Failed to destroy %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// runFromPool runs the config on an environment leased from its pool.
+func runFromPool(pool *Pool, config *Config, timeout time.Duration) *RunReport {
+	report := &RunReport{
+		Environment: config.Environment,
+		Start:       time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.Start)
+	}()
+
+	lease, err := pool.Acquire(timeout)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.StackID = lease.id
+
+	results, err := runTests(lease.Environment, config)
+	report.Connect = lease.connectDuration
+	report.addResults(results)
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	if err := lease.Release(!report.Failed()); err != nil {
+		logrus.Errorf("Failed to release %s: %v", lease.id, err)
+	}
+	return report
+}
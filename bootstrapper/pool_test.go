@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPool(t *testing.T, size int) (*Pool, *fakeCloudFormation, *StateStore, func()) {
+	store, cleanup := tempStateStore(t)
+	cf := newFakeCloudFormation()
+	config := &Config{Environment: testEnvironmentConfig(), Pool: &PoolConfig{Size: size}}
+	return NewPool(cf, store, config), cf, store, cleanup
+}
+
+func TestPoolAcquireTimeout(t *testing.T) {
+	defer func(interval time.Duration) { poolPollInterval = interval }(poolPollInterval)
+	poolPollInterval = time.Hour
+
+	pool, _, _, cleanup := testPool(t, 0)
+	defer cleanup()
+
+	start := time.Now()
+	_, err := pool.Acquire(10 * time.Millisecond)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "must not wait past the timeout")
+}
+
+func TestPoolRefill(t *testing.T) {
+	pool, cf, store, cleanup := testPool(t, 1)
+	defer cleanup()
+
+	assert.NoError(t, pool.fill())
+	lease, err := pool.Acquire(time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = pool.Acquire(0)
+	assert.Error(t, err, "the only environment is leased")
+
+	assert.NoError(t, lease.Release(false))
+	assert.Equal(t, "DELETE_COMPLETE", *cf.Stack(lease.id).StackStatus, "the environment of a failed run must be destroyed")
+	state, err := store.Load()
+	assert.NoError(t, err)
+	if assert.Len(t, state.Pool, 1, "a replacement must be provisioned") {
+		assert.NotEqual(t, lease.id, state.Pool[0].StackID)
+		assert.Nil(t, state.Pool[0].Lease)
+	}
+}
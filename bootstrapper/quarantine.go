@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// quarantineDateFormat is the format of the expiry dates.
+const quarantineDateFormat = "2006-01-02"
+
+// quarantineVar is the path of the quarantine file on the manager, set for
+// the commands so that TestMain excuses the quarantined failures too.
+const quarantineVar = "DOCKER_E2E_QUARANTINE"
+
+// remoteQuarantinePath is where the quarantine file is uploaded on the
+// manager.
+var remoteQuarantinePath = "/tmp/docker-e2e-quarantine.yml"
+
+// QuarantineEntry is a known-bad test. The same file is read by TestMain in
+// the tests package, keep both in sync.
+type QuarantineEntry struct {
+	Test   string `yaml:"test"`
+	Reason string `yaml:"reason"`
+	Issue  string `yaml:"issue,omitempty"`
+	// Expires is the last day the test is quarantined, as YYYY-MM-DD.
+	Expires string `yaml:"expires"`
+
+	expires time.Time
+}
+
+// expired returns whether the quarantine of the test is over at now.
+func (e QuarantineEntry) expired(now time.Time) bool {
+	return !now.Before(e.expires.AddDate(0, 0, 1))
+}
+
+func (e QuarantineEntry) String() string {
+	s := fmt.Sprintf("%s (%s", e.Test, e.Reason)
+	if e.Issue != "" {
+		s += ", " + e.Issue
+	}
+	return s + ", until " + e.Expires + ")"
+}
+
+// Quarantine lists the tests whose failures don't fail runs. They still run,
+// and their failures are reported separately. A nil *Quarantine is empty.
+type Quarantine struct {
+	entries map[string]QuarantineEntry
+}
+
+// LoadQuarantine reads the quarantine file at path. An empty path returns a
+// nil quarantine.
+func LoadQuarantine(path string) (*Quarantine, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read quarantine")
+	}
+	var entries []QuarantineEntry
+	if err := yaml.UnmarshalStrict(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "invalid quarantine %s", path)
+	}
+
+	q := &Quarantine{entries: make(map[string]QuarantineEntry)}
+	for i, e := range entries {
+		if e.Test == "" || e.Reason == "" || e.Expires == "" {
+			return nil, errors.Errorf("invalid quarantine %s: entry %d needs a test, a reason and an expiry date", path, i)
+		}
+		if e.expires, err = time.ParseInLocation(quarantineDateFormat, e.Expires, time.Local); err != nil {
+			return nil, errors.Errorf("invalid quarantine %s: %s expires on %q, expected YYYY-MM-DD", path, e.Test, e.Expires)
+		}
+		q.entries[e.Test] = e
+	}
+	return q, nil
+}
+
+// Check fails if entries expired, so they are either removed or extended
+// rather than silently hiding failures.
+func (q *Quarantine) Check(now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	expired := []string{}
+	for _, e := range q.entries {
+		if e.expired(now) {
+			expired = append(expired, e.String())
+		}
+	}
+	if len(expired) > 0 {
+		return errors.Errorf("quarantine expired for %s", strings.Join(expired, "; "))
+	}
+	return nil
+}
+
+// Has returns whether a test is quarantined. Subtests are quarantined with
+// their parent.
+func (q *Quarantine) Has(name string) bool {
+	if q == nil {
+		return false
+	}
+	_, ok := q.entries[strings.SplitN(name, "/", 2)[0]]
+	return ok
+}
+
+// excuse records the quarantined tests which failed in result, and returns
+// nil if result only failed because of them, cmdErr otherwise. TestMain
+// excuses quarantined failures itself, so they are looked for even if the
+// command succeeded. The failures are logged to log.
+func (q *Quarantine) excuse(log *logrus.Entry, result *Result, cmdErr error) error {
+	failed := failedTests(testResults(result))
+	quarantined := []string{}
+	for _, name := range failed {
+		if q.Has(name) {
+			quarantined = append(quarantined, name)
+		}
+	}
+	for _, name := range quarantined {
+		log.Warnf("==> Quarantined test failed: %s", q.entries[strings.SplitN(name, "/", 2)[0]])
+	}
+	if len(quarantined) > 0 {
+		result.Quarantined = quarantined
+	}
+
+	if len(failed) == 0 || len(quarantined) < len(failed) {
+		return cmdErr
+	}
+	return nil
+}
+
+// upload copies the quarantine file to the manager, and returns the
+// variables pointing the commands to it.
+func (q *Quarantine) upload(c *Environment, path string) (map[string]EnvValue, error) {
+	if q == nil {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := c.Upload(f, remoteQuarantinePath, 0644); err != nil {
+		return nil, err
+	}
+	return map[string]EnvValue{quarantineVar: {Value: remoteQuarantinePath}}, nil
+}
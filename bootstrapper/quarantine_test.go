@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeQuarantine(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+const testQuarantine = `
+- test: TestServicesRollingUpdateSucceed
+  reason: rolling updates hang when a node is drained
+  issue: https://github.com/docker/docker/issues/12345
+  expires: 2017-03-01
+`
+
+func TestLoadQuarantine(t *testing.T) {
+	path := writeQuarantine(t, testQuarantine)
+	defer os.Remove(path)
+
+	q, err := LoadQuarantine(path)
+	assert.NoError(t, err)
+	assert.True(t, q.Has("TestServicesRollingUpdateSucceed"))
+	assert.True(t, q.Has("TestServicesRollingUpdateSucceed/global"))
+	assert.False(t, q.Has("TestServicesCreate"))
+
+	assert.NoError(t, q.Check(time.Date(2017, 3, 1, 23, 59, 0, 0, time.Local)))
+	err = q.Check(time.Date(2017, 3, 2, 0, 0, 0, 0, time.Local))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "TestServicesRollingUpdateSucceed")
+	assert.Contains(t, err.Error(), "issues/12345")
+
+	var nilQuarantine *Quarantine
+	assert.False(t, nilQuarantine.Has("TestServicesCreate"))
+	assert.NoError(t, nilQuarantine.Check(time.Now()))
+
+	for _, invalid := range []string{
+		"- test: TestServicesCreate\n  expires: 2017-03-01\n",
+		"- test: TestServicesCreate\n  reason: flaky\n  expires: March 1st\n",
+		"- test: TestServicesCreate\n  reason: flaky\n  expires: 2017-03-01\n  owner: me\n",
+	} {
+		path := writeQuarantine(t, invalid)
+		_, err := LoadQuarantine(path)
+		assert.Error(t, err, invalid)
+		os.Remove(path)
+	}
+}
+
+func TestRunQuarantined(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+	path := writeQuarantine(t, `
+- test: TestServicesRollingUpdateSucceed
+  reason: rolling updates hang when a node is drained
+  expires: 2099-01-01
+`)
+	defer os.Remove(path)
+	defer func(path string) { remoteQuarantinePath = path }(remoteQuarantinePath)
+	remoteQuarantinePath = path + ".remote"
+	defer os.Remove(remoteQuarantinePath)
+
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+	config := &Config{
+		Environment: server.environmentConfig(),
+		Commands: []Command{
+			{Run: `printf -- "--- PASS: TestServicesCreate (1.00s)\n--- FAIL: TestServicesRollingUpdateSucceed (60.00s)\n"; exit 1`},
+			{Run: "true"},
+		},
+		Quarantine: path,
+		Quiet:      true,
+	}
+	report := runEnvironment(cf, "", config)
+	assert.False(t, report.Failed(), report.Error)
+	assert.Len(t, report.Steps, 2)
+	assert.Equal(t, []string{"TestServicesRollingUpdateSucceed"}, report.Quarantined())
+
+	config.Commands[0].Run = `printf -- "--- FAIL: TestServicesCreate (1.00s)\n--- FAIL: TestServicesRollingUpdateSucceed (60.00s)\n"; exit 1`
+	report = runEnvironment(cf, "", config)
+	assert.True(t, report.Failed(), "other failures must fail the run")
+	assert.Equal(t, []string{"TestServicesRollingUpdateSucceed"}, report.Quarantined())
+
+	// TestMain excuses the quarantined failures, reading the uploaded file.
+	config.Commands[0].Run = `grep -q TestServicesRollingUpdateSucceed "$DOCKER_E2E_QUARANTINE" && printf -- "--- FAIL: TestServicesRollingUpdateSucceed (60.00s)\n"`
+	report = runEnvironment(cf, "", config)
+	assert.False(t, report.Failed(), report.Error)
+	assert.Equal(t, []string{"TestServicesRollingUpdateSucceed"}, report.Quarantined(), "quarantined failures must be reported even if the command passed")
+}
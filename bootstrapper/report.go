@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RunReport summarizes the run of a config on an environment.
+type RunReport struct {
+	Name        string             `json:"name,omitempty"`
+	StackID     string             `json:"stack_id,omitempty"`
+	Environment *EnvironmentConfig `json:"environment,omitempty"`
+	// TestRun is the -run pattern selecting the tests, if the run only ran
+	// some of them.
+	TestRun string `json:"test_run,omitempty"`
+
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// Provisioning is how long the stack took to be created, Connect how
+	// long the SSH connection to the manager took to be established.
+	Provisioning time.Duration `json:"provisioning,omitempty"`
+	Connect      time.Duration `json:"connect,omitempty"`
+
+	// Events are the events of the stack until it was created, oldest
+	// first.
+	Events []StackEvent `json:"events,omitempty"`
+
+	Steps []StepReport `json:"steps"`
+	// Error is the reason the run failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// StackEvent is a CloudFormation event of a resource of the stack.
+type StackEvent struct {
+	Time     time.Time `json:"time"`
+	Resource string    `json:"resource"`
+	Type     string    `json:"type,omitempty"`
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// StepReport is the outcome of a single command.
+type StepReport struct {
+	Command    string        `json:"command"`
+	ExitStatus int           `json:"exit_status"`
+	Signal     string        `json:"signal,omitempty"`
+	Duration   time.Duration `json:"duration"`
+
+	// Tests are the results of the go tests run by the command, if it
+	// printed them (go test -v).
+	Tests []TestResult `json:"tests,omitempty"`
+	// Quarantined are the failed tests which didn't fail the step.
+	Quarantined []string `json:"quarantined,omitempty"`
+	// Logs is the path of the output of the step, see Result.
+	Logs string `json:"logs,omitempty"`
+}
+
+// Test statuses, as printed by go test.
+const (
+	TestPass = "PASS"
+	TestFail = "FAIL"
+	TestSkip = "SKIP"
+)
+
+// TestResult is the outcome of a single go test.
+type TestResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+
+	// Attempts is the number of times a retried test ran.
+	Attempts int `json:"attempts,omitempty"`
+	// Flaky is set if the test passed after failing.
+	Flaky bool `json:"flaky,omitempty"`
+	// Output is what a failed test logged, usually why it failed.
+	Output string `json:"output,omitempty"`
+}
+
+// Failed returns whether the run failed.
+func (r *RunReport) Failed() bool {
+	return r.Error != ""
+}
+
+// addResults records the outcome of the commands of the run.
+func (r *RunReport) addResults(results []*Result) {
+	for _, result := range results {
+		r.Steps = append(r.Steps, StepReport{
+			Command:     result.Command,
+			ExitStatus:  result.ExitStatus,
+			Signal:      result.Signal,
+			Duration:    result.Duration,
+			Tests:       testResults(result),
+			Quarantined: result.Quarantined,
+			Logs:        result.Logs,
+		})
+	}
+}
+
+// testResults returns the results of the tests of a command, updated with
+// their retries.
+func testResults(result *Result) []TestResult {
+	tests := parseTestResults(result.Stdout)
+	for _, retry := range result.Retries {
+		retried := parseTestResults(retry.Stdout)
+		status := testStatus(retried, retry.Test)
+		if status == "" {
+			status = TestFail
+		}
+		output := ""
+		for _, t := range retried {
+			if t.Name == retry.Test {
+				output = t.Output
+			}
+		}
+		for i := range tests {
+			t := &tests[i]
+			if t.Name != retry.Test {
+				continue
+			}
+			if t.Attempts == 0 {
+				t.Attempts = 1
+			}
+			t.Attempts++
+			t.Status = status
+			t.Flaky = status == TestPass
+			t.Output = output
+		}
+	}
+	return tests
+}
+
+// Quarantined returns the quarantined tests which failed.
+func (r *RunReport) Quarantined() []string {
+	tests := []string{}
+	for _, step := range r.Steps {
+		tests = append(tests, step.Quarantined...)
+	}
+	return tests
+}
+
+// Tests returns the results of the tests of all the steps.
+func (r *RunReport) Tests() []TestResult {
+	tests := []TestResult{}
+	for _, step := range r.Steps {
+		tests = append(tests, step.Tests...)
+	}
+	return tests
+}
+
+// testResultLine matches the result lines of go test -v, such as
+// "--- PASS: TestServicesCreate (12.34s)". Subtests are indented.
+var testResultLine = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)s\)`)
+
+// maxFailureLines is how many lines of the output of a failed test are kept.
+const maxFailureLines = 50
+
+// maxOutputLine is the longest line of test output which can be parsed.
+// Tests can log whole API responses on a single line.
+const maxOutputLine = 16 << 20
+
+// parseTestResults extracts the test results from the output of go test -v.
+// The output of failed tests is the lines following their result, indented
+// further.
+func parseTestResults(output []byte) []TestResult {
+	var tests []TestResult
+	// failed is the index of the failed test whose output is being read,
+	// indent the indentation of its result.
+	failed, indent := -1, 0
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, maxOutputLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := testResultLine.FindStringSubmatch(line)
+		if m == nil {
+			if failed < 0 || indentation(line) <= indent {
+				failed = -1
+				continue
+			}
+			lines++
+			if lines <= maxFailureLines {
+				tests[failed].Output += line[indent+1:] + "\n"
+			} else if lines == maxFailureLines+1 {
+				tests[failed].Output += "...\n"
+			}
+			continue
+		}
+		seconds, _ := strconv.ParseFloat(m[3], 64)
+		tests = append(tests, TestResult{
+			Name:     m[2],
+			Status:   m[1],
+			Duration: time.Duration(seconds * float64(time.Second)),
+		})
+		failed = -1
+		if m[1] == TestFail {
+			failed, indent, lines = len(tests)-1, indentation(line), 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.Warnf("Test results after %d tests are missing: %v", len(tests), err)
+	}
+	return tests
+}
+
+// indentation returns the number of leading spaces and tabs of line.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// writeJSON saves v as indented JSON.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
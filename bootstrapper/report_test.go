@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTestResults(t *testing.T) {
+	output := `=== RUN   TestServicesCreate
+--- PASS: TestServicesCreate (12.50s)
+=== RUN   TestServicesRollingUpdateSucceed
+--- FAIL: TestServicesRollingUpdateSucceed (61.00s)
+	services_test.go:120: timed out
+=== RUN   TestNetwork
+=== RUN   TestNetwork/overlay
+    --- SKIP: TestNetwork/overlay (0.00s)
+--- PASS: TestNetwork (0.01s)
+FAIL
+`
+	assert.Equal(t, []TestResult{
+		{Name: "TestServicesCreate", Status: TestPass, Duration: 12500 * time.Millisecond},
+		{Name: "TestServicesRollingUpdateSucceed", Status: TestFail, Duration: 61 * time.Second, Output: "services_test.go:120: timed out\n"},
+		{Name: "TestNetwork/overlay", Status: TestSkip},
+		{Name: "TestNetwork", Status: TestPass, Duration: 10 * time.Millisecond},
+	}, parseTestResults([]byte(output)))
+
+	assert.Empty(t, parseTestResults([]byte("Docker version 1.13.0, build 49bf474")))
+}
+
+func TestParseTestResultsLongLines(t *testing.T) {
+	output := "=== RUN   TestServicesCreate\n" + strings.Repeat("x", 1<<20) + "\n--- PASS: TestServicesCreate (1.00s)\n"
+	assert.Equal(t, []TestResult{
+		{Name: "TestServicesCreate", Status: TestPass, Duration: time.Second},
+	}, parseTestResults([]byte(output)))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// testRunVar is set to the pattern of the test a retry must run.
+const testRunVar = "DOCKER_E2E_TEST_RUN"
+
+// Retry re-runs the go tests failing in a command one by one, so that a
+// timing-sensitive test doesn't fail a whole run. Tests which pass on retry
+// are reported as flaky.
+//
+//	commands:
+//	  - run: docker run ... dockerswarm/e2e
+//	    retry:
+//	      attempts: 2
+//	      run: docker run ... dockerswarm/e2e go test -v -run "$DOCKER_E2E_TEST_RUN"
+type Retry struct {
+	// Attempts is how many times each failed test is re-run.
+	Attempts int `yaml:"attempts"`
+	// Run is the command running a single test, whose -run pattern is in
+	// $DOCKER_E2E_TEST_RUN.
+	Run string `yaml:"run"`
+}
+
+// retryFailedTests re-runs the failed tests of the i-th command, which ended
+// with cmdErr. Retries are added to result. It returns nil if all the failed
+// tests eventually passed.
+func retryFailedTests(c *Environment, cfg *Config, artifacts *Artifacts, i int, retry *Retry, result *Result, env *Env, cmdErr error) error {
+	failed := failedTests(parseTestResults(result.Stdout))
+	if len(failed) == 0 {
+		// The command failed for another reason, retrying tests won't help.
+		return cmdErr
+	}
+
+	remaining := []string{}
+	for _, name := range failed {
+		passed := false
+		for attempt := 1; attempt <= retry.Attempts && !passed; attempt++ {
+			cfg.logger().Warnf("==> Retrying %s (%d/%d)", name, attempt, retry.Attempts)
+			r, err := runStep(c, cfg, artifacts, fmt.Sprintf("%s.%s.retry-%d", stepName(i), name, attempt), retry.Run, env.with(testRunVar, "^"+name+"$"))
+			if r == nil {
+				return errors.Wrapf(err, "unable to retry %s", name)
+			}
+			r.Test = name
+			result.Retries = append(result.Retries, r)
+			passed = testStatus(parseTestResults(r.Stdout), name) == TestPass
+		}
+		if passed {
+			cfg.logger().Warnf("==> %s is flaky, it passed after failing", name)
+		} else {
+			remaining = append(remaining, name)
+		}
+	}
+
+	if len(remaining) > 0 {
+		return errors.Errorf("%s failed after %d retries", strings.Join(remaining, ", "), retry.Attempts)
+	}
+	return nil
+}
+
+// failedTests returns the failed top-level tests. Subtests are retried with
+// their parent.
+func failedTests(tests []TestResult) []string {
+	failed := []string{}
+	for _, t := range tests {
+		if t.Status == TestFail && !strings.Contains(t.Name, "/") {
+			failed = append(failed, t.Name)
+		}
+	}
+	return failed
+}
+
+// testStatus returns the last status of a test, or "" if it didn't run.
+func testStatus(tests []TestResult, name string) string {
+	status := ""
+	for _, t := range tests {
+		if t.Name == name {
+			status = t.Status
+		}
+	}
+	return status
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// retryScript fails a test the first time it is retried, and passes the
+// next ones.
+const retryScript = `t=${DOCKER_E2E_TEST_RUN#^}; t=${t%$}
+if [ -f retried-$t ]; then echo "--- PASS: $t (0.10s)"; else touch retried-$t; echo "--- FAIL: $t (0.10s)"; exit 1; fi`
+
+func runRetryConfig(t *testing.T, server *testSSHServer, commands ...Command) *RunReport {
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": server.sshOutput()}
+	}
+	return runEnvironment(cf, "", &Config{
+		Environment: server.environmentConfig(),
+		Commands:    commands,
+		Quiet:       true,
+	})
+}
+
+func TestRetryFlakyTests(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+
+	report := runRetryConfig(t, server,
+		Command{
+			Run:   `printf -- "--- PASS: TestServicesCreate (1.00s)\n--- FAIL: TestServicesRollingUpdateSucceed (60.00s)\n"; exit 1`,
+			Retry: &Retry{Attempts: 2, Run: retryScript},
+		},
+		Command{Run: "true"},
+	)
+	assert.False(t, report.Failed(), report.Error)
+	assert.Len(t, report.Steps, 2, "a flaky test must not stop the run")
+	assert.Equal(t, []TestResult{
+		{Name: "TestServicesCreate", Status: TestPass, Duration: 1e9},
+		{Name: "TestServicesRollingUpdateSucceed", Status: TestPass, Duration: 60e9, Attempts: 3, Flaky: true},
+	}, report.Tests())
+}
+
+func TestRetryFailingTests(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+
+	report := runRetryConfig(t, server,
+		Command{
+			Run:   `echo "--- FAIL: TestServicesRollingUpdateSucceed (60.00s)"; exit 1`,
+			Retry: &Retry{Attempts: 1, Run: retryScript},
+		},
+		Command{Run: "true"},
+	)
+	assert.True(t, report.Failed())
+	assert.Contains(t, report.Error, "TestServicesRollingUpdateSucceed failed after 1 retries")
+	assert.Len(t, report.Steps, 1)
+	assert.Equal(t, []TestResult{
+		{Name: "TestServicesRollingUpdateSucceed", Status: TestFail, Duration: 60e9, Attempts: 2},
+	}, report.Tests())
+}
+
+func TestRetryCommandFailure(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer server.Close()
+
+	report := runRetryConfig(t, server, Command{
+		Run:   `echo "Unable to find image 'dockerswarm/e2e:latest' locally"; exit 125`,
+		Retry: &Retry{Attempts: 2, Run: retryScript},
+	})
+	assert.True(t, report.Failed())
+	assert.Equal(t, 125, report.Steps[0].ExitStatus)
+	assert.Len(t, server.Received(), 1, "nothing to retry")
+}
+
+func TestFailedTests(t *testing.T) {
+	assert.Equal(t, []string{"TestNetwork", "TestServicesScale"}, failedTests([]TestResult{
+		{Name: "TestServicesCreate", Status: TestPass},
+		{Name: "TestNetwork/overlay", Status: TestFail},
+		{Name: "TestNetwork", Status: TestFail},
+		{Name: "TestServicesScale", Status: TestFail},
+	}))
+}
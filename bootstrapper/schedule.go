@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// What to do with the runs missed while the server was down.
+const (
+	missedSkip = "skip"
+	missedRun  = "run"
+)
+
+// Schedule periodically runs a config of the server, or purges the expired
+// stacks. See the README for an example.
+type Schedule struct {
+	Name string `yaml:"name"`
+	// Cron is when the schedule fires: a standard cron expression, in local
+	// time, a descriptor such as @daily, or "@every <duration>".
+	Cron string `yaml:"cron"`
+
+	// Config is the config to run, relative to the configs directory.
+	Config   string            `yaml:"config,omitempty"`
+	Vars     map[string]string `yaml:"vars,omitempty"`
+	Overlays []string          `yaml:"overlays,omitempty"`
+
+	// Purge deletes expired stacks instead of running a config.
+	Purge *PurgeSchedule `yaml:"purge,omitempty"`
+
+	// Jitter delays each run by a random duration up to this one, so that
+	// schedules firing at the same time don't all hit AWS at once.
+	Jitter string `yaml:"jitter,omitempty"`
+	// Missed is "run" to run once on startup if runs were missed while the
+	// server was down, or "skip" (the default).
+	Missed string `yaml:"missed,omitempty"`
+
+	cron   *cronSchedule
+	jitter time.Duration
+}
+
+// PurgeSchedule are the options of purge, with the defaults of the command.
+type PurgeSchedule struct {
+	TTL    string `yaml:"ttl,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+
+	ttl time.Duration
+}
+
+// request returns the run request of the schedule.
+func (s *Schedule) request() RunRequest {
+	return RunRequest{Config: s.Config, Vars: s.Vars, Overlays: s.Overlays}
+}
+
+// missed returns whether a run scheduled since last is overdue at now, and
+// should be run on startup.
+func (s *Schedule) missed(last, now time.Time) bool {
+	if s.Missed != missedRun || last.IsZero() {
+		return false
+	}
+	next := s.cron.Next(last)
+	return !next.IsZero() && !next.After(now)
+}
+
+// delay returns how long to wait before the run scheduled at next.
+func (s *Schedule) delay(next, now time.Time) time.Duration {
+	d := next.Sub(now)
+	if s.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+	return d
+}
+
+// LoadSchedules reads a list of schedules.
+func LoadSchedules(path string) ([]*Schedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read schedules")
+	}
+	var schedules []*Schedule
+	if err := yaml.UnmarshalStrict(data, &schedules); err != nil {
+		return nil, errors.Wrapf(err, "invalid schedules %s", path)
+	}
+
+	names := make(map[string]bool)
+	for i, s := range schedules {
+		if s.Name == "" {
+			return nil, errors.Errorf("invalid schedules %s: schedule %d has no name", path, i)
+		}
+		if names[s.Name] {
+			return nil, errors.Errorf("invalid schedules %s: duplicate schedule %s", path, s.Name)
+		}
+		names[s.Name] = true
+		if err := s.parse(); err != nil {
+			return nil, errors.Wrapf(err, "invalid schedules %s: %s", path, s.Name)
+		}
+	}
+	return schedules, nil
+}
+
+func (s *Schedule) parse() error {
+	var err error
+	if s.cron, err = parseCron(s.Cron); err != nil {
+		return err
+	}
+	if s.cron.Next(time.Now()).IsZero() {
+		return errors.Errorf("cron %q never fires", s.Cron)
+	}
+	if (s.Config == "") == (s.Purge == nil) {
+		return errors.New("one of config and purge must be set")
+	}
+	if s.Jitter != "" {
+		if s.jitter, err = time.ParseDuration(s.Jitter); err != nil {
+			return errors.Errorf("invalid jitter %q", s.Jitter)
+		}
+	}
+	switch s.Missed {
+	case "":
+		s.Missed = missedSkip
+	case missedSkip, missedRun:
+	default:
+		return errors.Errorf("invalid missed %q, expected %s or %s", s.Missed, missedSkip, missedRun)
+	}
+	if s.Purge != nil {
+		if s.Purge.TTL == "" {
+			s.Purge.TTL = "1h"
+		}
+		if s.Purge.Prefix == "" {
+			s.Purge.Prefix = defaultStackPrefix
+		}
+		if s.Purge.ttl, err = time.ParseDuration(s.Purge.TTL); err != nil {
+			return errors.Errorf("invalid purge ttl %q", s.Purge.TTL)
+		}
+	}
+	return nil
+}
+
+// Scheduler fires schedules, queueing their configs on a server. A schedule
+// doesn't fire while its previous run is still queued or running.
+type Scheduler struct {
+	Schedules []*Schedule
+	Server    *Server
+	// Store records when the schedules last fired.
+	Store *StateStore
+	// Purge deletes the expired stacks, as the purge command.
+	Purge func(prefix string, ttl time.Duration) error
+
+	mu   sync.Mutex
+	jobs map[string]int
+}
+
+// Run fires the schedules until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	s.jobs = make(map[string]int)
+	var wg sync.WaitGroup
+	for _, schedule := range s.Schedules {
+		wg.Add(1)
+		go func(schedule *Schedule) {
+			defer wg.Done()
+			s.loop(schedule, stop)
+		}(schedule)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) loop(schedule *Schedule, stop <-chan struct{}) {
+	entry := logrus.WithField("schedule", schedule.Name)
+	now := time.Now()
+	state, err := s.Store.Load()
+	if err != nil {
+		entry.Errorf("Unable to find when the schedule last fired: %v", err)
+	} else if last := state.Schedules[schedule.Name]; schedule.missed(last, now) {
+		entry.Warnf("Missed runs since %s, running now", last.Format(time.RFC3339))
+		s.fire(schedule, now)
+	}
+
+	next := schedule.cron.Next(now)
+	for !next.IsZero() {
+		delay := schedule.delay(next, time.Now())
+		entry.Debugf("Next run at %s", time.Now().Add(delay).Format(time.RFC3339))
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		s.fire(schedule, next)
+		// Runs are skipped rather than piled up if firing took longer than
+		// the period of the schedule.
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+		next = schedule.cron.Next(next)
+	}
+}
+
+// fire runs a schedule, scheduled at the given time, unless its previous run
+// is still going on.
+func (s *Scheduler) fire(schedule *Schedule, scheduled time.Time) {
+	entry := logrus.WithField("schedule", schedule.Name)
+	err := s.Store.Update(func(state *State) error {
+		if state.Schedules == nil {
+			state.Schedules = make(map[string]time.Time)
+		}
+		state.Schedules[schedule.Name] = scheduled
+		return nil
+	})
+	if err != nil {
+		entry.Errorf("Unable to record the run of the schedule: %v", err)
+	}
+
+	if schedule.Purge != nil {
+		// Purges run in the loop of the schedule, so they can't overlap.
+		entry.Infof("Purging stacks older than %s", schedule.Purge.TTL)
+		if err := s.Purge(schedule.Purge.Prefix, schedule.Purge.ttl); err != nil {
+			entry.Errorf("Unable to purge: %v", err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.jobs[schedule.Name]; ok {
+		switch status := s.Server.jobStatus(id); status {
+		case JobQueued, JobRunning:
+			entry.Warnf("Skipping run, the previous one (job %d) is still %s", id, status)
+			return
+		}
+	}
+	job, err := s.Server.enqueue(schedule.request(), schedule.Name)
+	if err != nil {
+		entry.Errorf("Unable to queue %s: %v", schedule.Config, err)
+		return
+	}
+	s.jobs[schedule.Name] = job.ID
+}
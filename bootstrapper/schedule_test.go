@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedules")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedules.yml")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+- name: nightly
+  cron: "0 2 * * *"
+  config: nightly.yml
+  vars: {TEMPLATE: https://example.com/nightly.json}
+  jitter: 10m
+  missed: run
+- name: purge
+  cron: "@hourly"
+  purge: {}
+`), 0644))
+	schedules, err := LoadSchedules(path)
+	assert.NoError(t, err)
+	if assert.Len(t, schedules, 2) {
+		assert.Equal(t, RunRequest{
+			Config: "nightly.yml",
+			Vars:   map[string]string{"TEMPLATE": "https://example.com/nightly.json"},
+		}, schedules[0].request())
+		assert.Equal(t, 10*time.Minute, schedules[0].jitter)
+		assert.Equal(t, missedSkip, schedules[1].Missed)
+		assert.Equal(t, time.Hour, schedules[1].Purge.ttl)
+		assert.Equal(t, defaultStackPrefix, schedules[1].Purge.Prefix)
+	}
+
+	for _, invalid := range []string{
+		"- {cron: '@daily', config: a.yml}",
+		"- {name: a, cron: '@daily', config: a.yml}\n- {name: a, cron: '@hourly', config: b.yml}",
+		"- {name: a, cron: '@often', config: a.yml}",
+		"- {name: a, cron: '0 0 30 2 *', config: a.yml}",
+		"- {name: a, cron: '@daily'}",
+		"- {name: a, cron: '@daily', config: a.yml, purge: {}}",
+		"- {name: a, cron: '@daily', config: a.yml, jitter: a bit}",
+		"- {name: a, cron: '@daily', config: a.yml, missed: queue}",
+		"- {name: a, cron: '@daily', purge: {ttl: forever}}",
+		"- {name: a, cron: '@daily', config: a.yml, when: now}",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, err := LoadSchedules(path)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestScheduleMissed(t *testing.T) {
+	c, err := parseCron("0 2 * * *")
+	assert.NoError(t, err)
+	s := &Schedule{Missed: missedRun, cron: c}
+	now := time.Date(2017, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	assert.True(t, s.missed(time.Date(2017, 3, 14, 2, 0, 0, 0, time.UTC), now))
+	assert.False(t, s.missed(time.Date(2017, 3, 15, 2, 0, 0, 0, time.UTC), now))
+	assert.False(t, s.missed(time.Time{}, now), "schedules which never fired haven't missed anything")
+	s.Missed = missedSkip
+	assert.False(t, s.missed(time.Date(2017, 3, 14, 2, 0, 0, 0, time.UTC), now))
+}
+
+func TestSchedulerFire(t *testing.T) {
+	ssh := newTestSSHServer(t)
+	defer ssh.Close()
+	server := newTestServer(t, ssh)
+	defer server.Close()
+	// Nothing runs the queue, so that jobs stay queued.
+	server.Start(0, 5)
+
+	store := NewStateStore(filepath.Join(server.dir, "state.json"))
+	purged := []string{}
+	scheduler := &Scheduler{
+		Server: server.Server,
+		Store:  store,
+		Purge: func(prefix string, ttl time.Duration) error {
+			purged = append(purged, prefix+" "+ttl.String())
+			return nil
+		},
+		jobs: make(map[string]int),
+	}
+	nightly := &Schedule{Name: "nightly", Cron: "@daily", Config: "smoke.yml"}
+	purge := &Schedule{Name: "purge", Cron: "@hourly", Purge: &PurgeSchedule{}}
+	assert.NoError(t, nightly.parse())
+	assert.NoError(t, purge.parse())
+
+	first := time.Date(2017, 3, 15, 0, 0, 0, 0, time.Local)
+	scheduler.fire(nightly, first)
+	scheduler.fire(nightly, first.AddDate(0, 0, 1))
+	scheduler.fire(purge, first)
+
+	jobs := []int{}
+	for id, job := range server.jobs {
+		jobs = append(jobs, id)
+		assert.Equal(t, "nightly", job.Schedule)
+	}
+	assert.Len(t, jobs, 1, "runs must not overlap")
+	assert.Equal(t, []string{"docker-e2e 1h0m0s"}, purged)
+
+	state, err := store.Load()
+	assert.NoError(t, err)
+	assert.True(t, first.AddDate(0, 0, 1).Equal(state.Schedules["nightly"]))
+	assert.True(t, first.Equal(state.Schedules["purge"]))
+
+	// Once the previous run is done, the schedule fires again.
+	server.finish(server.jobs[jobs[0]], "", nil)
+	scheduler.fire(nightly, first.AddDate(0, 0, 2))
+	assert.Len(t, server.jobs, 2)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/pkg/errors"
+)
+
+// Statuses of a job.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobPassed  = "passed"
+	JobFailed  = "failed"
+)
+
+// maxFinishedJobs is how many finished jobs the server remembers. Their
+// reports are kept in the history regardless.
+const maxFinishedJobs = 100
+
+// RunRequest asks the server to run a config. Configs are looked up in the
+// configs directory of the server, and loaded with the variables and
+// overlays of the request, as with --set and --overlay.
+type RunRequest struct {
+	Config   string            `json:"config"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Overlays []string          `json:"overlays,omitempty"`
+}
+
+// Job is a run requested to the server.
+type Job struct {
+	ID int `json:"id"`
+	// RunID identifies the run of the job in the logs and the history.
+	RunID   string     `json:"run_id"`
+	Request RunRequest `json:"request"`
+	// Schedule is the name of the schedule which queued the job, if any.
+	Schedule string `json:"schedule,omitempty"`
+	Status   string `json:"status"`
+
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	// Error is the reason the job failed, if it did.
+	Error   string       `json:"error,omitempty"`
+	Reports []*RunReport `json:"reports,omitempty"`
+
+	log *jobLog
+}
+
+// done returns whether the job is finished.
+func (j *Job) done() bool {
+	return j.Status == JobPassed || j.Status == JobFailed
+}
+
+// Server runs configs on behalf of HTTP clients, so that they don't need AWS
+// credentials. Runs are queued and executed a few at a time.
+//
+//	POST /runs           queue a RunRequest, returns the Job
+//	GET  /runs           list the jobs, most recent first
+//	GET  /runs/<id>      get a Job, with its reports once finished
+//	GET  /runs/<id>/logs stream the output of a job as server-sent events
+type Server struct {
+	// Configs is the directory of the configs clients may run.
+	Configs string
+	// Token is the bearer token clients must present, if set.
+	Token string
+	// Artifacts is the directory where the artifacts of each job are
+	// saved, in a subdirectory named after the job.
+	Artifacts string
+	// History is the path of the history the runs are saved in.
+	History string
+	// CloudFormation returns the client used to run config.
+	CloudFormation func(config *Config) cloudformationiface.CloudFormationAPI
+
+	mu     sync.Mutex
+	jobs   map[int]*Job
+	nextID int
+	queue  chan *Job
+}
+
+// Start starts concurrency workers processing a queue of up to queueSize
+// jobs.
+func (s *Server) Start(concurrency, queueSize int) {
+	s.jobs = make(map[int]*Job)
+	s.queue = make(chan *Job, queueSize)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for job := range s.queue {
+				s.execute(job)
+			}
+		}()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Token)) != 1 {
+			httpError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "runs" && r.Method == "POST":
+		s.submit(w, r)
+	case len(parts) == 1 && parts[0] == "runs" && r.Method == "GET":
+		s.list(w)
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "runs" && r.Method == "GET":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			httpError(w, http.StatusNotFound, "no such job")
+			return
+		}
+		s.mu.Lock()
+		job, ok := s.jobs[id]
+		s.mu.Unlock()
+		if !ok {
+			httpError(w, http.StatusNotFound, "no such job")
+			return
+		}
+		if len(parts) == 2 {
+			s.writeJob(w, http.StatusOK, job)
+		} else if parts[2] == "logs" {
+			s.streamLogs(w, r, job)
+		} else {
+			httpError(w, http.StatusNotFound, "not found")
+		}
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// submit queues a job.
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	var req RunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	// Load the config upfront to report mistakes to the client rather than
+	// in the job.
+	if _, err := s.loadConfig(req); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, err := s.enqueue(req, "")
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	s.writeJob(w, http.StatusAccepted, job)
+}
+
+// enqueue queues a job for req, on behalf of schedule if set.
+func (s *Server) enqueue(req RunRequest, schedule string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := &Job{
+		ID:       s.nextID + 1,
+		RunID:    newRunID(),
+		Request:  req,
+		Schedule: schedule,
+		Status:   JobQueued,
+		Created:  time.Now(),
+		log:      newJobLog(),
+	}
+	select {
+	case s.queue <- job:
+	default:
+		return nil, errors.New("too many queued runs")
+	}
+	s.nextID++
+	s.jobs[job.ID] = job
+	logrus.WithFields(logrus.Fields{"job": job.ID, "run_id": job.RunID}).Infof("Queued %s", req.Config)
+	return job, nil
+}
+
+// jobStatus returns the status of a job, or "" if the job isn't known
+// anymore.
+func (s *Server) jobStatus(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		return job.Status
+	}
+	return ""
+}
+
+// loadConfig loads the config of a request. Only configs of the configs
+// directory can be run.
+func (s *Server) loadConfig(req RunRequest) (*Config, error) {
+	name := filepath.Clean(req.Config)
+	if req.Config == "" || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return nil, errors.Errorf("invalid config %q", req.Config)
+	}
+	opts := &ConfigOptions{Vars: req.Vars, Overlays: req.Overlays}
+	if opts.Vars == nil {
+		opts.Vars = map[string]string{}
+	}
+	return loadConfig(filepath.Join(s.Configs, name), opts)
+}
+
+// isLoopback returns whether a listen address only accepts local
+// connections.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// execute runs a job, saving its reports in the history.
+func (s *Server) execute(job *Job) {
+	entry := logrus.WithFields(logrus.Fields{"job": job.ID, "run_id": job.RunID})
+	defer job.log.Close()
+
+	s.update(func() {
+		now := time.Now()
+		job.Started = &now
+		job.Status = JobRunning
+	})
+	entry.Infof("Running %s", job.Request.Config)
+	job.log.Printf("==> Running %s", job.Request.Config)
+
+	config, err := s.loadConfig(job.Request)
+	if err != nil {
+		s.finish(job, err.Error(), nil)
+		return
+	}
+	config.Quiet = true
+	config.output = job.log
+	// Everything logged during the run is tagged with the job.
+	config.Environment.log = entry
+	if config.Artifacts != "" || s.Artifacts != "" {
+		dir := s.Artifacts
+		if dir == "" {
+			dir = config.Artifacts
+		}
+		config.Artifacts = filepath.Join(dir, fmt.Sprintf("job-%d", job.ID))
+	}
+
+	cf := s.CloudFormation(config)
+	var reports []*RunReport
+	if config.Matrix != nil {
+		reports = runMatrix(cf, config)
+	} else {
+		reports = []*RunReport{runEnvironment(cf, "", config)}
+	}
+
+	saveHistory(s.History, "serve", job.Request.Config, job.RunID, reports...)
+	saveHTMLReport(config, reports...)
+	notifyRun(config, job.Request.Config, reports...)
+	exportMetrics(config.Metrics, job.Request.Config, reports...)
+
+	failed := []string{}
+	for _, r := range reports {
+		if r.Failed() {
+			failed = append(failed, r.Error)
+		}
+	}
+	s.finish(job, strings.Join(failed, "; "), reports)
+	entry.Infof("Finished %s: %s", job.Request.Config, job.Status)
+}
+
+// finish marks a job as done, and forgets the oldest finished jobs.
+func (s *Server) finish(job *Job, errMsg string, reports []*RunReport) {
+	s.update(func() {
+		now := time.Now()
+		job.Finished = &now
+		job.Reports = reports
+		job.Error = errMsg
+		job.Status = JobPassed
+		if errMsg != "" {
+			job.Status = JobFailed
+		}
+
+		finished := []int{}
+		for id, j := range s.jobs {
+			if j.done() {
+				finished = append(finished, id)
+			}
+		}
+		sort.Ints(finished)
+		for len(finished) > maxFinishedJobs {
+			delete(s.jobs, finished[0])
+			finished = finished[1:]
+		}
+	})
+	if errMsg != "" {
+		job.log.Printf("==> Failed: %s", errMsg)
+	} else {
+		job.log.Printf("==> Passed")
+	}
+}
+
+func (s *Server) update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+func (s *Server) list(w http.ResponseWriter) {
+	s.mu.Lock()
+	ids := []int{}
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	jobs := []Job{}
+	for _, id := range ids {
+		job := *s.jobs[id]
+		// The list only has the status of the jobs.
+		job.Reports = nil
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	writeJSONResponse(w, http.StatusOK, jobs)
+}
+
+func (s *Server) writeJob(w http.ResponseWriter, status int, job *Job) {
+	s.mu.Lock()
+	j := *job
+	s.mu.Unlock()
+	writeJSONResponse(w, status, &j)
+}
+
+// streamLogs sends the output of a job as server-sent events, one per line,
+// until the job is done or the client goes away. The last event is "done",
+// with the job as data.
+func (s *Server) streamLogs(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	next := 0
+	for {
+		lines, closed, changed := job.log.since(next)
+		next += len(lines)
+		for _, line := range lines {
+			fmt.Fprintf(w, "data: %s\n\n", line)
+		}
+		if closed {
+			s.mu.Lock()
+			data, _ := json.Marshal(job)
+			s.mu.Unlock()
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, message string) {
+	writeJSONResponse(w, status, map[string]string{"error": message})
+}
+
+// jobLog collects the output of a job line by line, and lets readers follow
+// it.
+type jobLog struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	closed  bool
+	// changed is closed, and replaced, whenever lines are added or the log
+	// is closed.
+	changed chan struct{}
+}
+
+func newJobLog() *jobLog {
+	return &jobLog{changed: make(chan struct{})}
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	added := false
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.lines = append(l.lines, string(bytes.TrimSuffix(l.partial[:i], []byte("\r"))))
+		l.partial = l.partial[i+1:]
+		added = true
+	}
+	if added {
+		l.notify()
+	}
+	return len(p), nil
+}
+
+// Printf adds a line to the log.
+func (l *jobLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(l, format+"\n", args...)
+}
+
+// Close adds the last line if it isn't terminated and marks the log as
+// complete.
+func (l *jobLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.partial) > 0 {
+		l.lines = append(l.lines, string(l.partial))
+		l.partial = nil
+	}
+	l.closed = true
+	l.notify()
+	return nil
+}
+
+// notify wakes up the readers. l.mu must be held.
+func (l *jobLog) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the lines from the n-th one, whether the log is complete,
+// and a channel closed once there is more to read.
+func (l *jobLog) since(n int) (lines []string, closed bool, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < len(l.lines) {
+		lines = append(lines, l.lines[n:]...)
+	}
+	return lines, l.closed, l.changed
+}
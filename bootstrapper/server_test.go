@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// testServer is a server running the configs of a temporary directory on
+// the test SSH server.
+type testServer struct {
+	*Server
+	HTTP *httptest.Server
+	dir  string
+}
+
+func newTestServer(t *testing.T, ssh *testSSHServer) *testServer {
+	dir, err := ioutil.TempDir("", "serve")
+	assert.NoError(t, err)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "configs"), 0755))
+
+	config, err := yaml.Marshal(&Config{
+		Environment: ssh.environmentConfig(),
+		Commands:    []Command{{Run: "echo $SUITE"}},
+	})
+	assert.NoError(t, err)
+	config = append(config, []byte("env:\n  SUITE: ${SUITE_NAME:-none}\n")...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "configs", "smoke.yml"), config, 0644))
+
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": ssh.sshOutput()}
+	}
+	s := &testServer{
+		Server: &Server{
+			Configs:   filepath.Join(dir, "configs"),
+			Artifacts: filepath.Join(dir, "artifacts"),
+			History:   filepath.Join(dir, "history.db"),
+			CloudFormation: func(*Config) cloudformationiface.CloudFormationAPI {
+				return cf
+			},
+		},
+		dir: dir,
+	}
+	s.HTTP = httptest.NewServer(s.Server)
+	return s
+}
+
+func (s *testServer) Close() {
+	s.HTTP.Close()
+	os.RemoveAll(s.dir)
+}
+
+// do sends a request to the server, with the token of the server.
+func (s *testServer) do(t *testing.T, method, path string, body interface{}) *http.Response {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		assert.NoError(t, err)
+	}
+	req, err := http.NewRequest(method, s.HTTP.URL+path, bytes.NewReader(data))
+	assert.NoError(t, err)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decodeJob(t *testing.T, resp *http.Response) *Job {
+	defer resp.Body.Close()
+	job := &Job{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(job))
+	return job
+}
+
+func TestServerRun(t *testing.T) {
+	ssh := newTestSSHServer(t)
+	defer ssh.Close()
+	s := newTestServer(t, ssh)
+	defer s.Close()
+	s.Token = "secret"
+	s.Start(1, 5)
+
+	resp := s.do(t, "POST", "/runs", RunRequest{Config: "smoke.yml", Vars: map[string]string{"SUITE_NAME": "smoke"}})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	job := decodeJob(t, resp)
+	assert.Equal(t, 1, job.ID)
+	assert.NotEmpty(t, job.RunID)
+	runID := job.RunID
+
+	// The logs are streamed until the job is done.
+	resp = s.do(t, "GET", "/runs/1/logs", nil)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	data := []string{}
+	var done *Job
+	event := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "done":
+			done = &Job{}
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), done))
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	resp.Body.Close()
+	assert.Contains(t, data, "$ echo $SUITE")
+	assert.Contains(t, data, "smoke")
+	if assert.NotNil(t, done, "the stream must end with the job") {
+		assert.Equal(t, JobPassed, done.Status, done.Error)
+	}
+
+	job = decodeJob(t, s.do(t, "GET", "/runs/1", nil))
+	assert.Equal(t, JobPassed, job.Status)
+	assert.NotNil(t, job.Finished)
+	if assert.Len(t, job.Reports, 1) {
+		assert.Len(t, job.Reports[0].Steps, 1)
+	}
+	stdout, err := ioutil.ReadFile(filepath.Join(s.Artifacts, "job-1", "step-01.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "smoke\n", string(stdout))
+
+	resp = s.do(t, "GET", "/runs", nil)
+	jobs := []Job{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	if assert.Len(t, jobs, 1) {
+		assert.Nil(t, jobs[0].Reports, "the list must only have the status")
+	}
+
+	history, err := OpenHistory(s.History)
+	assert.NoError(t, err)
+	defer history.Close()
+	records, err := history.List(HistoryFilter{})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "serve", records[0].Command)
+		assert.Equal(t, "smoke.yml", records[0].Config)
+		assert.Equal(t, runID, records[0].RunID, "the history must have the run ID of the job")
+	}
+}
+
+func TestServerJobLogs(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	assert.NoError(t, configureLogging(logFormatJSON, "info", "server"))
+
+	ssh := newTestSSHServer(t)
+	defer ssh.Close()
+	s := newTestServer(t, ssh)
+	defer s.Close()
+	s.Start(2, 5)
+
+	runIDs := map[string]string{}
+	jobs := []*Job{}
+	for _, suite := range []string{"one", "two"} {
+		job, err := s.enqueue(RunRequest{Config: "smoke.yml", Vars: map[string]string{"SUITE_NAME": suite}}, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		runIDs[suite] = job.RunID
+		jobs = append(jobs, job)
+	}
+	for _, job := range jobs {
+		for status := s.jobStatus(job.ID); status == JobQueued || status == JobRunning; status = s.jobStatus(job.ID) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	steps := map[string]bool{}
+	for _, entry := range jsonLogs(t, buf) {
+		msg, _ := entry["msg"].(string)
+		for suite, runID := range runIDs {
+			if strings.HasPrefix(msg, "$ ") && strings.Contains(msg, "SUITE="+suite+" ") {
+				steps[suite] = true
+				assert.Equal(t, runID, entry["run_id"], "the steps of a job must have its run ID")
+			}
+		}
+		if strings.HasPrefix(msg, "Stack ") || strings.HasPrefix(msg, "$ ") || strings.HasPrefix(msg, "==> ") {
+			assert.NotEqual(t, "server", entry["run_id"], "%q must have the run ID of its job", msg)
+		}
+	}
+	assert.Len(t, steps, 2)
+}
+
+func TestServerRejects(t *testing.T) {
+	ssh := newTestSSHServer(t)
+	defer ssh.Close()
+	s := newTestServer(t, ssh)
+	defer s.Close()
+	// Nothing runs the queue, so that it fills up.
+	s.Start(0, 1)
+
+	for _, name := range []string{"", "../smoke.yml", "configs/../../smoke.yml", filepath.Join(s.Configs, "smoke.yml"), "missing.yml"} {
+		resp := s.do(t, "POST", "/runs", RunRequest{Config: name})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+
+	resp := s.do(t, "POST", "/runs", RunRequest{Config: "smoke.yml"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp = s.do(t, "POST", "/runs", RunRequest{Config: "smoke.yml"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	job := decodeJob(t, s.do(t, "GET", "/runs/1", nil))
+	assert.Equal(t, JobQueued, job.Status)
+	resp = s.do(t, "GET", "/runs/2", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "rejected runs must not be kept")
+
+	s.Token = "secret"
+	req, err := http.NewRequest("GET", s.HTTP.URL+"/runs", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer guess")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestIsLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080"} {
+		assert.True(t, isLoopback(addr), addr)
+	}
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "10.0.0.1:8080", "bootstrapper:8080", "8080"} {
+		assert.False(t, isLoopback(addr), addr)
+	}
+}
+
+func TestJobLog(t *testing.T) {
+	l := newJobLog()
+	lines, closed, changed := l.since(0)
+	assert.Empty(t, lines)
+	assert.False(t, closed)
+
+	l.Write([]byte("first\r\nsec"))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("readers must be notified of new lines")
+	}
+	l.Write([]byte("ond\nlast"))
+	l.Close()
+
+	lines, closed, _ = l.since(1)
+	assert.Equal(t, []string{"second", "last"}, lines)
+	assert.True(t, closed)
+}
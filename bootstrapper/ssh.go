@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os/user"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sshUser = "docker"
+	sshPort = "22"
+)
+
+// JumpHost is an SSH server used as a proxy to reach the environment, such as
+// a bastion in front of managers running in private subnets.
+type JumpHost struct {
+	// Address is the host[:port] of the jump host.
+	Address string `yaml:"address"`
+
+	// User defaults to "docker".
+	User string `yaml:"user,omitempty"`
+	// KeyFile is the private key used to authenticate. Defaults to the key
+	// of the environment.
+	KeyFile string `yaml:"key_file,omitempty"`
+	// KnownHosts is an OpenSSH known_hosts file the key of the jump host is
+	// checked against. Defaults to EnvironmentConfig.KnownHosts; the key is
+	// not checked if neither is set.
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+}
+
+// sshHop is a single server of a connection chain.
+type sshHop struct {
+	address string
+	config  *ssh.ClientConfig
+}
+
+// hop returns the connection settings of the jump host. defaultKey and
+// defaultKnownHosts are used if the jump host has none of its own.
+func (h JumpHost) hop(defaultKey, defaultKnownHosts string) (sshHop, error) {
+	keyFile := h.KeyFile
+	if keyFile == "" {
+		keyFile = defaultKey
+	}
+	config, err := sshClientConfig(h.User, keyFile)
+	if err != nil {
+		return sshHop{}, errors.Wrapf(err, "jump host %s", h.Address)
+	}
+	knownHosts := h.KnownHosts
+	if knownHosts == "" {
+		knownHosts = defaultKnownHosts
+	}
+	if knownHosts != "" {
+		// Unlike the nodes, jump hosts are long-lived and their keys known.
+		if config.HostKeyCallback, err = knownhosts.New(knownHosts); err != nil {
+			return sshHop{}, errors.Wrapf(err, "jump host %s", h.Address)
+		}
+	}
+	return sshHop{address: withDefaultPort(h.Address), config: config}, nil
+}
+
+// defaultKeyFile returns the location of the private key of the environments.
+func defaultKeyFile() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, "/.ssh/swarm.pem"), nil
+}
+
+// sshClientConfig returns a client configuration authenticating as username
+// with the private key in keyFile. Empty values fall back to the defaults.
+func sshClientConfig(username, keyFile string) (*ssh.ClientConfig, error) {
+	if username == "" {
+		username = sshUser
+	}
+	if keyFile == "" {
+		var err error
+		if keyFile, err = defaultKeyFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read private key")
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse private key")
+	}
+
+	return &ssh.ClientConfig{
+		User: username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		// Environments are created on the fly, there is no way to know their
+		// host keys in advance.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, nil
+}
+
+// dialChain connects to the last hop, going through all the previous ones.
+// It returns the clients of every hop, the last one being connected to the
+// destination. They must all be closed once done, in reverse order.
+func dialChain(hops []sshHop) ([]*ssh.Client, error) {
+	clients := []*ssh.Client{}
+	for _, hop := range hops {
+		var (
+			client *ssh.Client
+			err    error
+		)
+		if len(clients) == 0 {
+			client, err = ssh.Dial("tcp", hop.address, hop.config)
+		} else {
+			client, err = dialThrough(clients[len(clients)-1], hop.address, hop.config)
+		}
+		if err != nil {
+			closeClients(clients)
+			return nil, errors.Wrapf(err, "unable to connect to %s", hop.address)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// dialThrough opens an SSH connection to address, tunneled through client.
+func dialThrough(client *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := client.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeClients closes a connection chain, starting from the last hop.
+func closeClients(clients []*ssh.Client) error {
+	var err error
+	for i := len(clients) - 1; i >= 0; i-- {
+		if e := clients[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, sshPort)
+}
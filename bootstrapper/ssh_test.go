@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestConnectThroughJumpHosts(t *testing.T) {
+	manager := newTestSSHServer(t)
+	defer manager.Close()
+	bastion := newTestSSHServer(t)
+	defer bastion.Close()
+	proxy := newTestSSHServer(t)
+	defer proxy.Close()
+
+	env, _ := newTestEnvironment(t, manager)
+	env.jumpHosts = []JumpHost{
+		{Address: bastion.Addr, KeyFile: bastion.KeyFile},
+		{Address: proxy.Addr, KeyFile: proxy.KeyFile},
+	}
+
+	assert.NoError(t, env.Connect())
+	_, err := env.Run("hostname", nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, env.Disconnect())
+
+	assert.Equal(t, []string{"hostname"}, manager.Received())
+	assert.Empty(t, bastion.Received(), "jump hosts must only forward")
+	assert.Empty(t, proxy.Received(), "jump hosts must only forward")
+}
+
+func TestConnectJumpHostUnreachable(t *testing.T) {
+	manager := newTestSSHServer(t)
+	defer manager.Close()
+	bastion := newTestSSHServer(t)
+	bastion.Close()
+
+	env, _ := newTestEnvironment(t, manager)
+	env.jumpHosts = []JumpHost{{Address: bastion.Addr}}
+	assert.Error(t, env.Connect())
+}
+
+func TestConnectJumpHostKnownHosts(t *testing.T) {
+	manager := newTestSSHServer(t)
+	defer manager.Close()
+	bastion := newTestSSHServer(t)
+	defer bastion.Close()
+	other := newTestSSHServer(t)
+	defer other.Close()
+
+	dir, err := ioutil.TempDir("", "known-hosts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{bastion.Addr}, bastion.HostKey) + "\n"
+	assert.NoError(t, ioutil.WriteFile(knownHosts, []byte(line), 0644))
+
+	env, _ := newTestEnvironment(t, manager)
+	env.jumpHosts = []JumpHost{{Address: bastion.Addr, KeyFile: bastion.KeyFile, KnownHosts: knownHosts}}
+	assert.NoError(t, env.Connect(), "the manager's key must not be checked")
+	assert.NoError(t, env.Disconnect())
+
+	// Another server answering on the address of the jump host.
+	env.jumpHosts = []JumpHost{{Address: bastion.Addr, KeyFile: bastion.KeyFile}}
+	env.knownHosts = filepath.Join(dir, "other")
+	line = knownhosts.Line([]string{bastion.Addr}, other.HostKey) + "\n"
+	assert.NoError(t, ioutil.WriteFile(env.knownHosts, []byte(line), 0644))
+	err = env.Connect()
+	if assert.Error(t, err, "the key of the jump host must be checked") {
+		assert.Contains(t, err.Error(), "key mismatch")
+	}
+
+	env.knownHosts = filepath.Join(dir, "missing")
+	assert.Error(t, env.Connect())
+}
+
+func TestDialNode(t *testing.T) {
+	manager := newTestSSHServer(t)
+	defer manager.Close()
+	worker := newTestSSHServer(t)
+	defer worker.Close()
+
+	env, _ := newTestEnvironment(t, manager)
+	_, err := env.DialNode(worker.Addr)
+	assert.Error(t, err, "environment is not connected")
+
+	assert.NoError(t, env.Connect())
+	defer env.Disconnect()
+
+	// Nodes normally share the key of the environment, the fixture servers
+	// each have their own.
+	env.keyFile = worker.KeyFile
+	client, err := env.DialNode(worker.Addr)
+	assert.NoError(t, err)
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Run("true"))
+	client.Close()
+
+	assert.Equal(t, []string{"true"}, worker.Received())
+}
+
+func TestConnectNode(t *testing.T) {
+	manager := newTestSSHServer(t)
+	defer manager.Close()
+	other := newTestSSHServer(t)
+	defer other.Close()
+
+	env, _ := newTestEnvironment(t, manager)
+	assert.NoError(t, env.Connect())
+	env.keyFile = other.KeyFile
+	assert.NoError(t, env.ConnectNode(other.Addr))
+	_, err := env.Run("hostname", nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, env.Disconnect())
+
+	assert.Empty(t, manager.Received(), "commands must run on the new manager")
+	assert.Equal(t, []string{"hostname"}, other.Received())
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:22", withDefaultPort("10.0.0.1"))
+	assert.Equal(t, "10.0.0.1:2222", withDefaultPort("10.0.0.1:2222"))
+	assert.Equal(t, "bastion.example.com:22", withDefaultPort("bastion.example.com"))
+}
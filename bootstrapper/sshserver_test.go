@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an SSH server running on localhost, executing commands in
+// a local shell. It only accepts the key in KeyFile, and forwards TCP
+// connections so it can be used as a jump host.
+type testSSHServer struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+	// KeyFile is the private key clients must authenticate with.
+	KeyFile string
+	// HostKey is the public key of the server.
+	HostKey ssh.PublicKey
+
+	mu sync.Mutex
+	// Delay is waited before running each command.
+	Delay time.Duration
+	// ExitCodes makes commands exit with the given code without running.
+	ExitCodes map[string]int
+	// Disconnect makes the server drop the connection when receiving one of
+	// these commands.
+	Disconnect map[string]bool
+	// AcceptEnv makes the server accept setenv requests.
+	AcceptEnv bool
+	// Commands lists the commands received, in order.
+	Commands []string
+
+	t        *testing.T
+	dir      string
+	config   *ssh.ServerConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// newTestSSHServer starts a server. It must be closed.
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	dir, err := ioutil.TempDir("", "sshserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientPub.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{
+		Addr:       listener.Addr().String(),
+		KeyFile:    keyFile,
+		HostKey:    hostSigner.PublicKey(),
+		ExitCodes:  make(map[string]int),
+		Disconnect: make(map[string]bool),
+		t:          t,
+		dir:        dir,
+		config:     config,
+		listener:   listener,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the server and removes its files.
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+}
+
+// Received returns the commands received so far.
+func (s *testSSHServer) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.Commands...)
+}
+
+func (s *testSSHServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			go s.handleSession(sconn, newChan)
+		case "direct-tcpip":
+			go s.handleForward(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// handleForward proxies a TCP connection, as requested by clients using the
+// server as a jump host.
+func (s *testSSHServer) handleForward(newChan ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &target); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+func (s *testSSHServer) handleSession(sconn *ssh.ServerConn, newChan ssh.NewChannel) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	env := []string{"PATH=" + os.Getenv("PATH"), "HOME=" + s.dir}
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &kv)
+			s.mu.Lock()
+			accept := s.AcceptEnv
+			s.mu.Unlock()
+			if accept {
+				env = append(env, kv.Name+"="+kv.Value)
+			}
+			req.Reply(accept, nil)
+		case "exec":
+			var cmd struct{ Command string }
+			ssh.Unmarshal(req.Payload, &cmd)
+			req.Reply(true, nil)
+
+			status, ok := s.exec(sconn, ch, cmd.Command, env)
+			if !ok {
+				return
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec runs a command of a session and returns its exit code. It returns
+// false if the connection was dropped instead.
+func (s *testSSHServer) exec(sconn *ssh.ServerConn, ch ssh.Channel, command string, env []string) (int, bool) {
+	s.mu.Lock()
+	s.Commands = append(s.Commands, command)
+	delay := s.Delay
+	code, forced := s.ExitCodes[command]
+	disconnect := s.Disconnect[command]
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+
+	if disconnect {
+		sconn.Close()
+		return 0, false
+	}
+	if forced {
+		return code, true
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = s.dir
+	cmd.Env = env
+	cmd.Stdin = ch
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), true
+		}
+		s.t.Logf("failed to run %q: %v", command, err)
+		return 127, true
+	}
+	return 0, true
+}
+
+// sshOutput returns a stack SSH output pointing to the server.
+func (s *testSSHServer) sshOutput() string {
+	return "ssh docker@" + s.Addr
+}
+
+// environmentConfig returns an environment config authenticating with the
+// key of the server.
+func (s *testSSHServer) environmentConfig() *EnvironmentConfig {
+	config := testEnvironmentConfig()
+	config.SSHKeyFile = s.KeyFile
+	return config
+}
+
+// newTestEnvironment provisions an environment whose manager is the server.
+func newTestEnvironment(t *testing.T, s *testSSHServer) (*Environment, *fakeCloudFormation) {
+	cf := newFakeCloudFormation()
+	cf.Outputs = func(name string) map[string]string {
+		return map[string]string{"SSH": s.sshOutput()}
+	}
+	env, err := Provision(cf, "docker-e2e-20160928-0", s.environmentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env, cf
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// State is the local bookkeeping of the bootstrapper, shared between
+// invocations.
+type State struct {
+	// Pool lists the stacks of the warm environment pools.
+	Pool []*PoolStack `json:"pool,omitempty"`
+	// Usage lists the stacks created recently, for the budget.
+	Usage []*Usage `json:"usage,omitempty"`
+	// Schedules records when each schedule last fired, to catch up on the
+	// runs missed while the server was down.
+	Schedules map[string]time.Time `json:"schedules,omitempty"`
+}
+
+// StateStore persists the State as a JSON file. Accesses are serialized with
+// a lock file so several bootstrappers can run on the same machine.
+type StateStore struct {
+	path string
+}
+
+// defaultStatePath returns the location of the state if none is specified.
+func defaultStatePath() string {
+	usr, err := user.Current()
+	if err != nil {
+		return "docker-e2e-state.json"
+	}
+	return filepath.Join(usr.HomeDir, ".docker-e2e", "state.json")
+}
+
+// NewStateStore returns a store saving the state at path.
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+// Load returns the current state.
+func (s *StateStore) Load() (*State, error) {
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.read()
+}
+
+// Update loads the state, lets fn modify it and saves it back, holding an
+// exclusive lock for the whole operation. The state is not saved if fn
+// returns an error.
+func (s *StateStore) Update(fn func(*State) error) error {
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+	return s.write(state)
+}
+
+func (s *StateStore) lock(how int) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "unable to lock state")
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *StateStore) read() (*State, error) {
+	state := &State{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "corrupted state %s", s.path)
+	}
+	return state, nil
+}
+
+func (s *StateStore) write(state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash can't leave a truncated
+	// state behind.
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// Upgrade describes an in-place upgrade scenario: the environment is
+// provisioned with the template of the environment section, the Before
+// commands are run, the stack is updated to Template and the After commands
+// are run.
+//
+//	upgrade:
+//	  template: https://docker-for-aws.s3.amazonaws.com/aws/nightly/latest.json
+//	  before:
+//	    - docker service create --name survivor --label e2etesting nginx
+//	  after:
+//	    - docker service ps survivor
+type Upgrade struct {
+	Template string `yaml:"template"`
+
+	Before []Command `yaml:"before,omitempty"`
+	After  []Command `yaml:"after,omitempty"`
+}
+
+// runUpgrade runs the upgrade scenario of config.
+func runUpgrade(cf cloudformationiface.CloudFormationAPI, config *Config) *RunReport {
+	report := &RunReport{
+		Name:        "upgrade",
+		Environment: config.Environment,
+		Start:       time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.Start)
+	}()
+
+	provisionStart := time.Now()
+	env, err := provisionEnvironment(cf, config.Environment)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.StackID = env.id
+	report.Provisioning = time.Since(provisionStart)
+
+	// Bring down the environment once we're done.
+	defer env.Destroy()
+
+	before := upgradePhase(config, "before", config.Upgrade.Before)
+	results, err := runTests(env, before)
+	report.Connect = env.connectDuration
+	report.addResults(results)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	upgraded := *config.Environment
+	upgraded.Template = config.Upgrade.Template
+	log := config.logger()
+	log.Infof("Upgrading %s from %s to %s", env.id, config.Environment.Template, upgraded.Template)
+	now := time.Now()
+	if err := env.Update(&upgraded); err != nil {
+		log.Errorf("==> Upgrade failed after %v: %s", time.Since(now), err)
+		report.Error = err.Error()
+		return report
+	}
+	log.Infof("==> Upgrade completed in %v", time.Since(now))
+
+	after := upgradePhase(config, "after", config.Upgrade.After)
+	results, err = runTests(env, after)
+	report.addResults(results)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// upgradePhase returns the config running the commands of a phase of the
+// upgrade, saving their output apart from the other phase.
+func upgradePhase(config *Config, phase string, commands []Command) *Config {
+	c := *config
+	c.Commands = commands
+	if c.Artifacts != "" {
+		c.Artifacts = filepath.Join(c.Artifacts, phase)
+	}
+	return &c
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/pkg/errors"
+)
+
+// Limits of the Docker for AWS templates.
+var (
+	managerSizes = []int{1, 3, 5}
+	maxWorkers   = 1000
+)
+
+// ConfigError reports all the problems found in a config file.
+type ConfigError struct {
+	File     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s:\n  %s", e.File, strings.Join(e.Problems, "\n  "))
+}
+
+// configFile is the schema of a config file before it is merged with the
+// configs it extends.
+type configFile struct {
+	Config `yaml:",inline"`
+
+	Extends  interface{}       `yaml:"extends,omitempty"`
+	Include  interface{}       `yaml:"include,omitempty"`
+	Overlays map[string]Config `yaml:"overlays,omitempty"`
+}
+
+// checkSchema strictly decodes a config file, reporting unknown keys and
+// values of the wrong type along with their line number.
+func checkSchema(file string, data []byte) error {
+	err := yaml.UnmarshalStrict(data, &configFile{})
+	if err == nil {
+		return nil
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		return &ConfigError{File: file, Problems: typeErr.Errors}
+	}
+	return &ConfigError{File: file, Problems: []string{strings.TrimPrefix(err.Error(), "yaml: ")}}
+}
+
+// Validate checks that the config is complete enough to be run.
+func (c *Config) Validate() error {
+	problems := []string{}
+	if c.Environment == nil {
+		problems = append(problems, "environment is missing")
+	} else if c.Matrix == nil {
+		problems = append(problems, c.Environment.problems()...)
+	}
+
+	if len(c.Commands) == 0 && c.Upgrade == nil {
+		problems = append(problems, "no commands to run")
+	}
+	problems = append(problems, commandProblems("commands", c.Commands)...)
+	problems = append(problems, envProblems("env", c.Env)...)
+
+	if c.Upgrade != nil {
+		if c.Upgrade.Template == "" {
+			problems = append(problems, "upgrade.template is missing")
+		} else if err := checkTemplateLocation(c.Upgrade.Template); err != nil {
+			problems = append(problems, fmt.Sprintf("upgrade.template: %v", err))
+		}
+		if len(c.Upgrade.Before)+len(c.Upgrade.After) == 0 {
+			problems = append(problems, "upgrade: no commands to run")
+		}
+		problems = append(problems, commandProblems("upgrade.before", c.Upgrade.Before)...)
+		problems = append(problems, commandProblems("upgrade.after", c.Upgrade.After)...)
+	}
+
+	if c.Matrix != nil {
+		if c.Matrix.Concurrency < 0 {
+			problems = append(problems, "matrix.concurrency: must not be negative")
+		}
+		for _, entry := range c.Matrix.Expand(c.Environment) {
+			for _, p := range entry.Environment.problems() {
+				problems = append(problems, fmt.Sprintf("matrix %s: %s", entry.Name, p))
+			}
+		}
+	}
+
+	if c.Pool != nil && c.Pool.Size < 0 {
+		problems = append(problems, "pool.size: must not be negative")
+	}
+
+	if c.Quarantine != "" {
+		quarantine, err := LoadQuarantine(c.Quarantine)
+		if err == nil {
+			err = quarantine.Check(time.Now())
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("quarantine: %v", err))
+		}
+	}
+
+	problems = append(problems, killLeaderProblems(c)...)
+	problems = append(problems, c.Notify.problems()...)
+	problems = append(problems, c.Metrics.problems()...)
+
+	if c.Budget != nil {
+		if c.Budget.MaxStacks < 0 {
+			problems = append(problems, "budget.max_stacks: must not be negative")
+		}
+		if c.Budget.MaxInstanceHours < 0 {
+			problems = append(problems, "budget.max_instance_hours: must not be negative")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Validate checks the environment parameters before provisioning.
+func (c *EnvironmentConfig) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ConfigError{File: "environment", Problems: problems}
+	}
+	return nil
+}
+
+func (c *EnvironmentConfig) problems() []string {
+	problems := []string{}
+	if c.Template == "" {
+		problems = append(problems, "environment.template is missing")
+	} else if err := checkTemplateLocation(c.Template); err != nil {
+		problems = append(problems, fmt.Sprintf("environment.template: %v", err))
+	}
+	if c.SSHKeyName == "" {
+		problems = append(problems, "environment.ssh_keyname is missing")
+	}
+	if c.InstanceType == "" {
+		problems = append(problems, "environment.instance_type is missing")
+	}
+
+	validManagers := false
+	for _, size := range managerSizes {
+		if c.Managers == size {
+			validManagers = true
+		}
+	}
+	if !validManagers {
+		problems = append(problems, fmt.Sprintf("environment.managers: must be one of %v, got %d", managerSizes, c.Managers))
+	}
+	if c.Workers < 0 || c.Workers > maxWorkers {
+		problems = append(problems, fmt.Sprintf("environment.workers: must be between 0 and %d, got %d", maxWorkers, c.Workers))
+	}
+
+	for i, j := range c.JumpHosts {
+		if j.Address == "" {
+			problems = append(problems, fmt.Sprintf("environment.jump_hosts[%d].address is missing", i))
+		}
+	}
+	return append(problems, c.Naming.problems()...)
+}
+
+// killLeaderProblems checks that the environments have a manager to connect
+// to when the leader is killed.
+func killLeaderProblems(c *Config) []string {
+	commands := map[string][]Command{"commands": c.Commands}
+	if c.Upgrade != nil {
+		commands["upgrade.before"] = c.Upgrade.Before
+		commands["upgrade.after"] = c.Upgrade.After
+	}
+	paths := []string{}
+	for path, cmds := range commands {
+		for i, cmd := range cmds {
+			if cmd.Chaos != nil && cmd.Chaos.Action == chaosKillLeader {
+				paths = append(paths, fmt.Sprintf("%s[%d].chaos", path, i))
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	problems := []string{}
+	for _, entry := range c.Environments() {
+		if entry.Environment == nil || entry.Environment.Managers != 1 {
+			continue
+		}
+		for _, path := range paths {
+			problem := fmt.Sprintf("%s: kill-leader needs more than one manager", path)
+			if entry.Name != "" {
+				problem = fmt.Sprintf("matrix %s: %s", entry.Name, problem)
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func commandProblems(path string, commands []Command) []string {
+	problems := []string{}
+	for i, cmd := range commands {
+		if cmd.Chaos != nil {
+			if cmd.Run != "" || cmd.Retry != nil {
+				problems = append(problems, fmt.Sprintf("%s[%d]: chaos can't be combined with run or retry", path, i))
+			}
+			problems = append(problems, cmd.Chaos.problems(fmt.Sprintf("%s[%d].chaos", path, i))...)
+			continue
+		}
+		if strings.TrimSpace(cmd.Run) == "" {
+			problems = append(problems, fmt.Sprintf("%s[%d]: command is empty", path, i))
+		}
+		problems = append(problems, envProblems(fmt.Sprintf("%s[%d].env", path, i), cmd.Env)...)
+		if cmd.Retry != nil {
+			if cmd.Retry.Attempts < 1 {
+				problems = append(problems, fmt.Sprintf("%s[%d].retry.attempts: must be at least 1", path, i))
+			}
+			if strings.TrimSpace(cmd.Retry.Run) == "" {
+				problems = append(problems, fmt.Sprintf("%s[%d].retry.run is missing", path, i))
+			}
+		}
+	}
+	return problems
+}
+
+func envProblems(path string, env map[string]EnvValue) []string {
+	problems := []string{}
+	for name, v := range env {
+		sources := 0
+		for _, s := range []string{v.Value, v.FromEnv, v.FromFile} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			problems = append(problems, fmt.Sprintf("%s.%s: only one of value, from_env and from_file can be set", path, name))
+		}
+	}
+	return problems
+}
+
+// isTemplateURL returns whether template is a URL rather than a local file.
+func isTemplateURL(template string) bool {
+	return strings.HasPrefix(template, "http://") || strings.HasPrefix(template, "https://")
+}
+
+// checkTemplateLocation checks that the template is a well-formed URL or an
+// existing local file, without fetching it.
+func checkTemplateLocation(template string) error {
+	if !isTemplateURL(template) {
+		if _, err := os.Stat(template); err != nil {
+			return errors.Errorf("not a http(s) URL nor a readable file: %v", err)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(template)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return errors.Errorf("invalid URL %s", template)
+	}
+	return nil
+}
+
+// checkTemplate verifies that a template URL can be fetched.
+func checkTemplate(template string) error {
+	if !isTemplateURL(template) {
+		return checkTemplateLocation(template)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Head(template)
+	if err != nil {
+		return errors.Wrap(err, "unable to reach template")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unable to fetch template %s: %s", template, resp.Status)
+	}
+	return nil
+}
@@ -3,14 +3,30 @@ package dockere2e
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
 	// gotta call this at the start or NONE of the flags work
 	flag.Parse()
 
+	// load the known-bad tests. expired entries fail the whole run, so they
+	// get fixed or extended instead of hiding failures forever
+	quarantine, err := LoadQuarantine(os.Getenv(QuarantineEnv))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if expired := ExpiredQuarantine(quarantine, time.Now()); len(expired) > 0 {
+		for _, e := range expired {
+			fmt.Fprintf(os.Stderr, "quarantine of %s expired on %s (%s)\n", e.Test, e.Expires, e.Issue)
+		}
+		os.Exit(1)
+	}
+
 	// we need a client
 	cli, err := GetClient()
 	if err != nil {
@@ -20,8 +36,9 @@ func TestMain(m *testing.M) {
 	// clean up the testing services that might have existed before we start
 	CleanTestServices(context.Background(), cli)
 
-	// run the tests, save the exit code
-	exit := m.Run()
+	// run the tests, save the exit code. failures of quarantined tests don't
+	// count
+	exit := RunQuarantined(m, quarantine)
 	// and then bow out
 	os.Exit(exit)
 }